@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// apiMaxLimit caps the page size of the list endpoints
+const apiMaxLimit = 1000
+
+// APIHandler serves the rest api over the database:
+//
+//	GET  /meetings?limit=&offset=
+//	GET  /meetings/{uuid}
+//	GET  /records?status=&record_type=&file_type=&host=&since=&until=&limit=
+//	POST /records/{id}/retry
+//	POST /sync
+type APIHandler struct {
+	token []byte
+	sync  func()
+	mux   *http.ServeMux
+}
+
+func NewAPIHandler(token string, sync func()) *APIHandler {
+	h := &APIHandler{token: []byte(token), sync: sync, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/meetings", h.listMeetings)
+	h.mux.HandleFunc("/records", h.listRecords)
+	h.mux.HandleFunc("/records/", h.retryRecord)
+	h.mux.HandleFunc("/sync", h.triggerSync)
+	return h
+}
+
+func (h *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		log.Warn().Str("remote", r.RemoteAddr).Str("path", r.URL.Path).Msg("Rejected api request")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="z2gd"`)
+		apiError(w, http.StatusUnauthorized, "invalid bearer token")
+		return
+	}
+	// the mux cleans paths, zoom uuids may contain "//" or start with "/"
+	if strings.HasPrefix(r.URL.Path, "/meetings/") {
+		h.getMeeting(w, r)
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// authorized checks the bearer token of the request
+func (h *APIHandler) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), h.token) == 1
+}
+
+func (h *APIHandler) listMeetings(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	limit, offset, err := pageParams(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	meetings, err := sqliteDatabase.ListMeetings(limit, offset)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list meetings")
+		apiError(w, http.StatusInternalServerError, "unable to list meetings")
+		return
+	}
+	infos := make([]MeetingInfo, 0, len(meetings))
+	for _, m := range meetings {
+		infos = append(infos, m.Info())
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (h *APIHandler) getMeeting(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	// zoom uuids may contain slashes, everything after the prefix is the uuid
+	uuid := strings.TrimPrefix(r.URL.Path, "/meetings/")
+	if uuid == "" {
+		apiError(w, http.StatusNotFound, "not found")
+		return
+	}
+	meeting, err := sqliteDatabase.GetMeetingWithRecords(uuid)
+	if errors.Is(err, ErrNotFound) {
+		apiError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("meeting_uuid", uuid).Msg("Failed to get meeting")
+		apiError(w, http.StatusInternalServerError, "unable to get meeting")
+		return
+	}
+	writeJSON(w, http.StatusOK, meeting.Info())
+}
+
+func (h *APIHandler) listRecords(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	q := r.URL.Query()
+	limit, _, err := pageParams(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter := RecordFilter{
+		Statuses:      queryList(q.Get("status")),
+		Types:         queryList(q.Get("record_type")),
+		FileExtension: q.Get("file_type"),
+		Hosts:         queryList(q.Get("host")),
+		Limit:         limit,
+	}
+	if since := q.Get("since"); since != "" {
+		t, err := time.Parse(time.DateOnly, since)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "invalid since, want YYYY-MM-DD")
+			return
+		}
+		filter.Since = t.Format(time.DateOnly)
+	}
+	if until := q.Get("until"); until != "" {
+		t, err := time.Parse(time.DateOnly, until)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "invalid until, want YYYY-MM-DD")
+			return
+		}
+		filter.Until = t.AddDate(0, 0, 1).Format(time.DateOnly)
+	}
+
+	records, err := sqliteDatabase.ListRecords(filter)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list records")
+		apiError(w, http.StatusInternalServerError, "unable to list records")
+		return
+	}
+	infos := make([]RecordInfo, 0, len(records))
+	for _, rec := range records {
+		infos = append(infos, rec.Info())
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// retryRecord queues a record again and triggers a sync
+func (h *APIHandler) retryRecord(w http.ResponseWriter, r *http.Request) {
+	id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/records/"), "/retry")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		apiError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	record, err := sqliteDatabase.GetRecord(id)
+	if errors.Is(err, ErrNotFound) {
+		apiError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("record_id", id).Msg("Failed to get record")
+		apiError(w, http.StatusInternalServerError, "unable to get record")
+		return
+	}
+	if record.Status == Synced {
+		apiError(w, http.StatusConflict, "record is already synced")
+		return
+	}
+	err = sqliteDatabase.UpdateRecord(record.Id, Queued)
+	if err != nil {
+		log.Error().Err(err).Str("record_id", id).Msg("Failed to queue record")
+		apiError(w, http.StatusInternalServerError, "unable to queue record")
+		return
+	}
+	record.Status = Queued
+	log.Info().Str("record_id", record.Id).Str("remote", r.RemoteAddr).Msg("Record queued by api, sync queued")
+	h.sync()
+	writeJSON(w, http.StatusAccepted, record.Info())
+}
+
+func (h *APIHandler) triggerSync(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	log.Info().Str("remote", r.RemoteAddr).Msg("Sync queued by api")
+	h.sync()
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "queued"})
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+// pageParams parses the limit and offset query parameters
+func pageParams(r *http.Request) (limit, offset int, err error) {
+	limit, offset = 100, 0
+	q := r.URL.Query()
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > apiMaxLimit {
+			return 0, 0, errors.New("invalid limit, want 1 to " + strconv.Itoa(apiMaxLimit))
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("invalid offset")
+		}
+	}
+	return limit, offset, nil
+}
+
+// queryList splits a comma separated query parameter
+func queryList(v string) []string {
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// serveAPI serves the rest api until ctx is done, triggered syncs fetch the
+// recordings first when client.fetch_api is set
+func serveAPI(ctx context.Context, cfg config) error {
+	if cfg.APICfg.Token == "" {
+		return errors.New("api.token is required")
+	}
+
+	trigger, done := startSyncTrigger(ctx, "api", func(ctx context.Context) error {
+		return runCycle(ctx, cfg)
+	})
+	server := &http.Server{Addr: cfg.APICfg.Listen, Handler: NewAPIHandler(cfg.APICfg.Token, trigger), ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Info().Str("listen", cfg.APICfg.Listen).Msg("Serving the rest api")
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	// let the running sync finish its in-flight transfers
+	<-done
+	return nil
+}
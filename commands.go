@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rs/zerolog/log"
+)
+
+// command is a z2gd subcommand
+type command struct {
+	name  string
+	args  []string // names of the positional arguments
+	help  string
+	flags func(fs *flag.FlagSet, cfg *config) // binds the flags overriding the config
+	run   func(ctx context.Context, cfg config, args []string) error
+}
+
+var commands = []*command{
+	{
+		name:  "run",
+		help:  "fetch and sync once, then serve the webhooks and api when enabled (default)",
+		flags: func(fs *flag.FlagSet, cfg *config) { fetchFlags(fs, cfg); syncFlags(fs, cfg) },
+		run:   runCommand,
+	},
+	{
+		name:  "daemon",
+		help:  "fetch and sync on the daemon schedule until stopped",
+		flags: func(fs *flag.FlagSet, cfg *config) { fetchFlags(fs, cfg); syncFlags(fs, cfg) },
+		run:   daemonCommand,
+	},
+	{
+		name:  "fetch",
+		help:  "save the zoom recordings to the database without syncing",
+		flags: fetchFlags,
+		run:   fetchCommand,
+	},
+	{
+		name:  "sync",
+		help:  "sync the unsynced records of the database without fetching",
+		flags: syncFlags,
+		run:   syncCommand,
+	},
+	{
+		name: "status",
+		help: "count the records per status, type and extension",
+		run:  statusCommand,
+	},
+	{
+		name:  "report",
+		help:  "report the sync state per record or meeting as a table, json or csv",
+		flags: reportFlags,
+		run:   reportCommand,
+	},
+	{
+		name:  "list",
+		help:  "list the records",
+		flags: listFlags,
+		run:   listCommand,
+	},
+	{
+		name: "show",
+		args: []string{"meeting-uuid"},
+		help: "show a meeting with its records, destinations and permissions",
+		run:  showCommand,
+	},
+	{
+		name:  "retry",
+		args:  []string{"record-id"},
+		help:  "queue a record again and sync it right away",
+		flags: retryFlags,
+		run:   retryCommand,
+	},
+	{
+		name:  "reset",
+		help:  "queue the records with the given statuses again",
+		flags: resetFlags,
+		run:   resetCommand,
+	},
+	{
+		name: "forget",
+		args: []string{"meeting-uuid"},
+		help: "delete a meeting and its records from the database, the next fetch saves it again",
+		run:  forgetCommand,
+	},
+	{
+		name: "revoke-shares",
+		args: []string{"record-id"},
+		help: "revoke the drive permissions granted on a record",
+		run:  revokeSharesCommand,
+	},
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: %s [-c config.yml] [-d] [command] [flags] [args]\n\nCommands:\n", os.Args[0])
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", strings.Join(append([]string{cmd.name}, cmd.args...), " "), cmd.help)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nRun \"%s <command> -h\" for the flags of a command.\n", os.Args[0])
+}
+
+// flagSet returns the flags of the command bound to cfg, the global flags are
+// accepted after the command too
+func (c *command) flagSet(cfg *config, global func(fs *flag.FlagSet)) *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ExitOnError)
+	global(fs)
+	fs.StringVar(&cfg.ClientCfg.DbLocation, "db", cfg.ClientCfg.DbLocation, "sqlite database, overrides client.db_location")
+	if c.flags != nil {
+		c.flags(fs, cfg)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags]\n\n%s\n\nFlags:\n", os.Args[0], strings.Join(append([]string{c.name}, c.args...), " "), c.help)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// stringList is a comma separated flag replacing a configured list
+type stringList struct {
+	list *[]string
+}
+
+func (s stringList) String() string {
+	if s.list == nil {
+		return ""
+	}
+	return strings.Join(*s.list, ",")
+}
+
+func (s stringList) Set(v string) error {
+	*s.list = nil
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*s.list = append(*s.list, item)
+		}
+	}
+	return nil
+}
+
+func fetchFlags(fs *flag.FlagSet, cfg *config) {
+	fs.UintVar(&cfg.ClientCfg.Cutoff, "cutoff", cfg.ClientCfg.Cutoff, "unix time of the oldest recording, overrides client.cutoff")
+	fs.Var(stringList{&cfg.ClientCfg.UserIds}, "user-ids", "comma separated zoom user ids or emails, overrides client.user_ids")
+	fs.BoolVar(&cfg.ZoomCfg.Users.Discover, "discover", cfg.ZoomCfg.Users.Discover, "list the zoom users, overrides zoom.users.discover")
+	fs.BoolVar(&cfg.ZoomCfg.Users.AccountRecordings, "account-recordings", cfg.ZoomCfg.Users.AccountRecordings, "use the account recordings api, overrides zoom.users.account_recordings")
+}
+
+// syncFlags binds the sync overrides, the cutoff may be bound by fetchFlags
+func syncFlags(fs *flag.FlagSet, cfg *config) {
+	fs.BoolVar(&cfg.ClientCfg.DryRun, "dry-run", cfg.ClientCfg.DryRun, "only log, overrides client.dry_run")
+	fs.StringVar(&cfg.ClientCfg.FileType, "file-type", cfg.ClientCfg.FileType, "file extension to sync, overrides client.file_type")
+	fs.Var(stringList{&cfg.ClientCfg.RecordType}, "record-type", "comma separated recording types, overrides client.record_type")
+	if fs.Lookup("cutoff") == nil {
+		fs.UintVar(&cfg.ClientCfg.Cutoff, "cutoff", cfg.ClientCfg.Cutoff, "unix time of the oldest recording, overrides client.cutoff")
+	}
+	fs.UintVar(&cfg.ClientCfg.Retry, "retry", cfg.ClientCfg.Retry, "retries per record, overrides client.retry")
+	fs.UintVar(&cfg.ClientCfg.DownloadWorkers, "download-workers", cfg.ClientCfg.DownloadWorkers, "overrides client.download_workers")
+	fs.UintVar(&cfg.ClientCfg.UploadWorkers, "upload-workers", cfg.ClientCfg.UploadWorkers, "overrides client.upload_workers")
+	fs.BoolVar(&cfg.ClientCfg.Stream, "stream", cfg.ClientCfg.Stream, "stream without a local file, overrides client.stream")
+	fs.StringVar(&cfg.ClientCfg.DownloadLocation, "download-location", cfg.ClientCfg.DownloadLocation, "overrides client.download_location")
+}
+
+func runCommand(ctx context.Context, cfg config, args []string) error {
+	err := connectDrive(ctx, cfg, false)
+	if err != nil {
+		return err
+	}
+	err = connectZoom(cfg, false)
+	if err != nil {
+		return err
+	}
+
+	err = runCycle(ctx, cfg)
+	if errors.Is(err, errLeaseHeld) {
+		log.Warn().Msg("Another instance is syncing, skipping this run")
+	} else if err != nil {
+		return err
+	}
+
+	if cfg.WebhookCfg.Enabled || cfg.APICfg.Enabled {
+		return serveListeners(ctx, cfg)
+	}
+	return nil
+}
+
+func daemonCommand(ctx context.Context, cfg config, args []string) error {
+	err := connectDrive(ctx, cfg, false)
+	if err != nil {
+		return err
+	}
+	err = connectZoom(cfg, false)
+	if err != nil {
+		return err
+	}
+	return runDaemon(ctx, cfg)
+}
+
+func fetchCommand(ctx context.Context, cfg config, args []string) error {
+	err := connectZoom(cfg, true)
+	if err != nil {
+		return err
+	}
+	return withSyncLease(ctx, cfg, func(ctx context.Context) error {
+		return fetchMeetings(ctx, cfg)
+	})
+}
+
+func syncCommand(ctx context.Context, cfg config, args []string) error {
+	cfg.ClientCfg.FetchAPI = false
+	err := connectDrive(ctx, cfg, false)
+	if err != nil {
+		return err
+	}
+	err = connectZoom(cfg, false)
+	if err != nil {
+		return err
+	}
+	return withSyncLease(ctx, cfg, func(ctx context.Context) error {
+		return syncRecords(ctx, cfg)
+	})
+}
+
+func statusCommand(ctx context.Context, cfg config, args []string) error {
+	counts, err := sqliteDatabase.CountRecordsGrouped()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tTYPE\tEXTENSION\tRECORDS\tSIZE")
+	var total uint
+	var totalSize FileSize
+	for _, c := range counts {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", c.Status, c.Type, c.FileExtension, c.Count, c.Size)
+		total += c.Count
+		totalSize += c.Size
+	}
+	fmt.Fprintf(tw, "total\t\t\t%d\t%s\n", total, totalSize)
+	return tw.Flush()
+}
+
+var listFilter RecordFilter
+
+func listFlags(fs *flag.FlagSet, cfg *config) {
+	listFilter = RecordFilter{Limit: 50}
+	fs.Var(stringList{&listFilter.Statuses}, "status", "comma separated record statuses")
+	fs.Var(stringList{&listFilter.Types}, "record-type", "comma separated recording types")
+	fs.StringVar(&listFilter.FileExtension, "file-type", "", "file extension")
+	fs.StringVar(&listFilter.Since, "since", "", "oldest recording start, YYYY-MM-DD")
+	fs.IntVar(&listFilter.Limit, "limit", listFilter.Limit, "maximum number of records, 0 lists all")
+}
+
+func listCommand(ctx context.Context, cfg config, args []string) error {
+	records, err := sqliteDatabase.ListRecords(listFilter)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RECORD ID\tMEETING UUID\tSTART\tTYPE\tEXTENSION\tSIZE\tSTATUS\tPATH")
+	for _, r := range records {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Id, r.MeetingId, r.DateTime, r.Type, r.FileExtension, r.FileSize, r.Status, r.FilePath)
+	}
+	return tw.Flush()
+}
+
+func showCommand(ctx context.Context, cfg config, args []string) error {
+	meet, err := sqliteDatabase.GetMeeting(args[0])
+	if err != nil {
+		return err
+	}
+	records, err := sqliteDatabase.GetRecords(meet.UUID)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "UUID:\t%s\n", meet.UUID)
+	fmt.Fprintf(tw, "Meeting id:\t%d\n", meet.Id)
+	fmt.Fprintf(tw, "Topic:\t%s\n", meet.Topic)
+	fmt.Fprintf(tw, "Start:\t%s\n", meet.DateTime)
+	fmt.Fprintf(tw, "Duration:\t%d min\n", meet.Duration)
+	fmt.Fprintf(tw, "Host:\t%s %s\n", meet.HostEmail, meet.HostId)
+	for _, r := range records {
+		fmt.Fprintf(tw, "\nRecord:\t%s\n", r.Id)
+		fmt.Fprintf(tw, "  Type:\t%s %s\n", r.Type, r.FileExtension)
+		fmt.Fprintf(tw, "  Size:\t%s\n", r.FileSize)
+		fmt.Fprintf(tw, "  Status:\t%s\n", r.Status)
+		if r.Md5 != "" {
+			fmt.Fprintf(tw, "  Md5:\t%s\n", r.Md5)
+		}
+		if r.FilePath != "" {
+			fmt.Fprintf(tw, "  Path:\t%s\n", r.FilePath)
+			fmt.Fprintf(tw, "  Uploaded:\t%s, %s\n", r.UploadedAt, r.UploadedSize)
+		}
+		if r.DriveFileId != "" {
+			fmt.Fprintf(tw, "  Drive file id:\t%s\n", r.DriveFileId)
+			fmt.Fprintf(tw, "  Drive folder id:\t%s\n", r.DriveFolderId)
+			fmt.Fprintf(tw, "  Drive link:\t%s\n", r.WebViewLink)
+		}
+
+		dests, err := sqliteDatabase.GetRecordDestinations(r.Id)
+		if err != nil {
+			return err
+		}
+		for _, d := range dests {
+			fmt.Fprintf(tw, "  Destination %s:\t%s, %d attempts, %s\n", d.Destination, d.Status, d.Attempts, d.UpdatedAt)
+			if d.RemoteId != "" {
+				fmt.Fprintf(tw, "    Remote id:\t%s\n", d.RemoteId)
+				fmt.Fprintf(tw, "    Link:\t%s\n", d.Link)
+			}
+			if d.LastError != "" {
+				fmt.Fprintf(tw, "    Last error:\t%s\n", d.LastError)
+			}
+		}
+
+		perms, err := sqliteDatabase.GetDrivePermissions(r.Id)
+		if err != nil {
+			return err
+		}
+		for _, p := range perms {
+			state := "granted " + p.GrantedAt
+			if p.RevokedAt != "" {
+				state = "revoked " + p.RevokedAt
+			}
+			fmt.Fprintf(tw, "  Shared with %s %s:\t%s, %s\n", p.Type, p.Target, p.Role, state)
+		}
+	}
+	return tw.Flush()
+}
+
+var retryQueueOnly bool
+
+func retryFlags(fs *flag.FlagSet, cfg *config) {
+	syncFlags(fs, cfg)
+	fs.BoolVar(&retryQueueOnly, "queue-only", false, "only queue the record for the next sync")
+}
+
+func retryCommand(ctx context.Context, cfg config, args []string) error {
+	record, err := sqliteDatabase.GetRecord(args[0])
+	if err != nil {
+		return err
+	}
+	if record.Status == Synced {
+		return fmt.Errorf("record %s is already synced", record.Id)
+	}
+	err = sqliteDatabase.UpdateRecord(record.Id, Queued)
+	if err != nil {
+		return err
+	}
+	record.Status = Queued
+	log.Info().Str("record_id", record.Id).Msg("Record queued")
+	if retryQueueOnly || cfg.ClientCfg.DryRun {
+		return nil
+	}
+
+	meet, err := sqliteDatabase.GetMeeting(record.MeetingId)
+	if err != nil {
+		return err
+	}
+	meet.Records = []Record{*record}
+
+	cfg.ClientCfg.FetchAPI = false
+	err = connectDrive(ctx, cfg, false)
+	if err != nil {
+		return err
+	}
+	err = connectZoom(cfg, false)
+	if err != nil {
+		return err
+	}
+	err = withSyncLease(ctx, cfg, func(ctx context.Context) error {
+		syncMeetings(ctx, cfg, []Meeting{*meet})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	record, err = sqliteDatabase.GetRecord(record.Id)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("record_id", record.Id).Str("status", string(record.Status)).Str("path", record.FilePath).Msg("Record retried")
+	if record.Status != Synced {
+		return fmt.Errorf("record %s is %s", record.Id, record.Status)
+	}
+	return nil
+}
+
+var resetStatuses = []string{string(Failed)}
+
+func resetFlags(fs *flag.FlagSet, cfg *config) {
+	fs.Var(stringList{&resetStatuses}, "status", "comma separated statuses of the records to queue again")
+}
+
+func resetCommand(ctx context.Context, cfg config, args []string) error {
+	n, err := sqliteDatabase.ResetRecords(resetStatuses)
+	if err != nil {
+		return err
+	}
+	log.Info().Strs("statuses", resetStatuses).Int64("records", n).Msg("Records queued again")
+	return nil
+}
+
+func forgetCommand(ctx context.Context, cfg config, args []string) error {
+	meet, err := sqliteDatabase.GetMeeting(args[0])
+	if err != nil {
+		return err
+	}
+	n, err := sqliteDatabase.ForgetMeeting(meet.UUID)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("meeting_uuid", meet.UUID).Str("topic", meet.Topic).Int64("records", n).Msg("Meeting forgotten")
+	return nil
+}
+
+func revokeSharesCommand(ctx context.Context, cfg config, args []string) error {
+	err := connectDrive(ctx, cfg, true)
+	if err != nil {
+		return err
+	}
+	return revokeShares(args[0])
+}
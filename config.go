@@ -62,10 +62,69 @@ func loadEnvSliceOfString(key string, result *[]string) {
 }
 
 /* Configuration */
+type zoomUsersConfig struct {
+	Discover          bool     `yaml:"discover" json:"discover"`                     // list users through the zoom users api instead of client.user_ids
+	AccountRecordings bool     `yaml:"account_recordings" json:"account_recordings"` // use the account level recordings api
+	IncludePending    bool     `yaml:"include_pending" json:"include_pending"`
+	IncludeInactive   bool     `yaml:"include_inactive" json:"include_inactive"`
+	IncludeEmails     []string `yaml:"include_emails" json:"include_emails"`
+	ExcludeEmails     []string `yaml:"exclude_emails" json:"exclude_emails"`
+	IncludeGroups     []string `yaml:"include_groups" json:"include_groups"` // zoom group ids
+	ExcludeGroups     []string `yaml:"exclude_groups" json:"exclude_groups"`
+	IncludeRoles      []string `yaml:"include_roles" json:"include_roles"` // zoom role ids
+	ExcludeRoles      []string `yaml:"exclude_roles" json:"exclude_roles"`
+}
+
+func (u zoomUsersConfig) statuses() []string {
+	statuses := []string{"active"}
+	if u.IncludeInactive {
+		statuses = append(statuses, "inactive")
+	}
+	if u.IncludePending {
+		statuses = append(statuses, "pending")
+	}
+	return statuses
+}
+
+func (u zoomUsersConfig) filter() UserFilter {
+	return UserFilter{
+		IncludeEmails: u.IncludeEmails,
+		ExcludeEmails: u.ExcludeEmails,
+		IncludeGroups: u.IncludeGroups,
+		ExcludeGroups: u.ExcludeGroups,
+		IncludeRoles:  u.IncludeRoles,
+		ExcludeRoles:  u.ExcludeRoles,
+	}
+}
+
+func (u *zoomUsersConfig) loadFromEnv() {
+	loadEnvBool("ZDG_ZOOM_USERS_DISCOVER", &u.Discover)
+	loadEnvBool("ZDG_ZOOM_USERS_ACCOUNT_RECORDINGS", &u.AccountRecordings)
+	loadEnvBool("ZDG_ZOOM_USERS_INCLUDE_PENDING", &u.IncludePending)
+	loadEnvBool("ZDG_ZOOM_USERS_INCLUDE_INACTIVE", &u.IncludeInactive)
+	loadEnvSliceOfString("ZDG_ZOOM_USERS_INCLUDE_EMAILS", &u.IncludeEmails)
+	loadEnvSliceOfString("ZDG_ZOOM_USERS_EXCLUDE_EMAILS", &u.ExcludeEmails)
+	loadEnvSliceOfString("ZDG_ZOOM_USERS_INCLUDE_GROUPS", &u.IncludeGroups)
+	loadEnvSliceOfString("ZDG_ZOOM_USERS_EXCLUDE_GROUPS", &u.ExcludeGroups)
+	loadEnvSliceOfString("ZDG_ZOOM_USERS_INCLUDE_ROLES", &u.IncludeRoles)
+	loadEnvSliceOfString("ZDG_ZOOM_USERS_EXCLUDE_ROLES", &u.ExcludeRoles)
+}
+
 type zoomConfig struct {
-	ClientID     string `yaml:"client_id" json:"client_id"`
-	ClientSecret string `yaml:"client_secret" json:"client_secret"`
-	AccountID    string `yaml:"account_id" json:"account_id"`
+	ClientID     string          `yaml:"client_id" json:"client_id"`
+	ClientSecret string          `yaml:"client_secret" json:"client_secret"`
+	AccountID    string          `yaml:"account_id" json:"account_id"`
+	Users        zoomUsersConfig `yaml:"users" json:"users"`
+	MaxRetries   uint            `yaml:"max_retries" json:"max_retries"`
+	MaxRetryWait uint            `yaml:"max_retry_wait" json:"max_retry_wait"` // seconds
+	LightRate    uint            `yaml:"light_rate" json:"light_rate"`         // requests per second
+	MediumRate   uint            `yaml:"medium_rate" json:"medium_rate"`
+	HeavyRate    uint            `yaml:"heavy_rate" json:"heavy_rate"`
+
+	DeleteDownloaded bool `yaml:"delete_downloaded" json:"delete_downloaded"` // permanently delete synced recordings from zoom
+	TrashDownloaded  bool `yaml:"trash_downloaded" json:"trash_downloaded"`   // move synced recordings to the zoom trash, wins over delete_downloaded
+	CleanupDryRun    bool `yaml:"cleanup_dry_run" json:"cleanup_dry_run"`     // only log the recordings that would be deleted
+	DeleteSkipped    bool `yaml:"delete_skipped" json:"delete_skipped"`       // purge recordings below client.min_duration or client.min_file_size from zoom
 }
 
 func defaultZoomConfig() zoomConfig {
@@ -73,6 +132,14 @@ func defaultZoomConfig() zoomConfig {
 		ClientID:     "thisisclientid",
 		ClientSecret: "thisisclientsecret",
 		AccountID:    "thisisaccountid",
+		Users:        zoomUsersConfig{},
+		MaxRetries:   5,
+		MaxRetryWait: 300,
+		LightRate:    30,
+		MediumRate:   20,
+		HeavyRate:    10,
+		// deleting from zoom cannot be undone, only a preview unless turned off
+		CleanupDryRun: true,
 	}
 }
 
@@ -80,23 +147,98 @@ func (z *zoomConfig) loadFromEnv() {
 	loadEnvStr("ZDG_ZOOM_CLIENT_ID", &z.ClientID)
 	loadEnvStr("ZDG_ZOOM_CLIENT_SECRET", &z.ClientSecret)
 	loadEnvStr("ZDG_ZOOM_ACCOUNT_ID", &z.AccountID)
+	loadEnvUint("ZDG_ZOOM_MAX_RETRIES", &z.MaxRetries)
+	loadEnvUint("ZDG_ZOOM_MAX_RETRY_WAIT", &z.MaxRetryWait)
+	loadEnvUint("ZDG_ZOOM_LIGHT_RATE", &z.LightRate)
+	loadEnvUint("ZDG_ZOOM_MEDIUM_RATE", &z.MediumRate)
+	loadEnvUint("ZDG_ZOOM_HEAVY_RATE", &z.HeavyRate)
+	loadEnvBool("ZDG_ZOOM_DELETE_DOWNLOADED", &z.DeleteDownloaded)
+	loadEnvBool("ZDG_ZOOM_TRASH_DOWNLOADED", &z.TrashDownloaded)
+	loadEnvBool("ZDG_ZOOM_CLEANUP_DRY_RUN", &z.CleanupDryRun)
+	loadEnvBool("ZDG_ZOOM_DELETE_SKIPPED", &z.DeleteSkipped)
+	z.Users.loadFromEnv()
+}
+
+type routeConfig struct {
+	Name          string   `yaml:"name" json:"name"`
+	Topic         string   `yaml:"topic" json:"topic"` // regular expression
+	HostIds       []string `yaml:"host_ids" json:"host_ids"`
+	HostEmails    []string `yaml:"host_emails" json:"host_emails"`
+	MeetingIds    []uint64 `yaml:"meeting_ids" json:"meeting_ids"`
+	RecordTypes   []string `yaml:"record_types" json:"record_types"`
+	MinDuration   uint     `yaml:"min_duration" json:"min_duration"` // minutes
+	MaxDuration   uint     `yaml:"max_duration" json:"max_duration"` // minutes
+	Destination   string   `yaml:"destination" json:"destination"`   // defaults to client.destination
+	Destinations  []string `yaml:"destinations" json:"destinations"` // archive to several destinations
+	FolderName    string   `yaml:"folder_name" json:"folder_name"`   // defaults to drive.folder_name
+	SharedDriveId string   `yaml:"shared_drive_id" json:"shared_drive_id"`
+	Skip          bool     `yaml:"skip" json:"skip"` // do not archive matching records
+}
+
+type driveSharingConfig struct {
+	Role         string   `yaml:"role" json:"role"`                 // reader, commenter or writer
+	Host         bool     `yaml:"host" json:"host"`                 // share with the meeting host
+	Participants bool     `yaml:"participants" json:"participants"` // share with the signed in participants, needs the zoom report scope
+	Groups       []string `yaml:"groups" json:"groups"`             // google group emails
+	Domain       string   `yaml:"domain" json:"domain"`             // share with everyone of the domain having the link
+	Notify       bool     `yaml:"notify" json:"notify"`             // send the drive notification email
+}
+
+// enabled reports whether any grantee is configured
+func (s driveSharingConfig) enabled() bool {
+	return s.Host || s.Participants || len(s.Groups) > 0 || s.Domain != ""
+}
+
+func (s *driveSharingConfig) loadFromEnv() {
+	loadEnvStr("ZDG_DRIVE_SHARING_ROLE", &s.Role)
+	loadEnvBool("ZDG_DRIVE_SHARING_HOST", &s.Host)
+	loadEnvBool("ZDG_DRIVE_SHARING_PARTICIPANTS", &s.Participants)
+	loadEnvSliceOfString("ZDG_DRIVE_SHARING_GROUPS", &s.Groups)
+	loadEnvStr("ZDG_DRIVE_SHARING_DOMAIN", &s.Domain)
+	loadEnvBool("ZDG_DRIVE_SHARING_NOTIFY", &s.Notify)
 }
 
 type driveConfig struct {
-	Credentials string `yaml:"credentials" json:"credentials"`
-	FolderName  string `yaml:"folder_name" json:"folder_name"`
+	Auth           string             `yaml:"auth" json:"auth"`               // oauth, service_account or delegation
+	Credentials    string             `yaml:"credentials" json:"credentials"` // oauth client secret or service account key file
+	TokenFile      string             `yaml:"token_file" json:"token_file"`   // cached oauth user token
+	Impersonate    string             `yaml:"impersonate" json:"impersonate"` // user email impersonated with delegation
+	FolderName     string             `yaml:"folder_name" json:"folder_name"`
+	SharedDriveId  string             `yaml:"shared_drive_id" json:"shared_drive_id"` // store in a shared drive instead of my drive
+	ConflictPolicy string             `yaml:"conflict_policy" json:"conflict_policy"` // skip, replace or revision
+	FolderTemplate string             `yaml:"folder_template" json:"folder_template"` // folders below folder_name, "/" nests them
+	FileTemplate   string             `yaml:"file_template" json:"file_template"`     // unique per record, e.g. with {{.RecordId}}
+	Routes         []routeConfig      `yaml:"routes" json:"routes"`                   // first matching route wins
+	Sharing        driveSharingConfig `yaml:"sharing" json:"sharing"`
 }
 
 func defaultDriveConfig() driveConfig {
 	return driveConfig{
-		Credentials: "credentials.json",
-		FolderName:  "z2gd",
+		Auth:           string(AuthOAuth),
+		Credentials:    "credentials.json",
+		TokenFile:      "token.json",
+		Impersonate:    "",
+		FolderName:     "z2gd",
+		SharedDriveId:  "",
+		ConflictPolicy: string(ConflictSkip),
+		FolderTemplate: defaultFolderTemplate,
+		FileTemplate:   defaultFileTemplate,
+		Routes:         []routeConfig{},
+		Sharing:        driveSharingConfig{Role: "reader"},
 	}
 }
 
 func (d *driveConfig) loadFromEnv() {
+	loadEnvStr("ZDG_DRIVE_AUTH", &d.Auth)
 	loadEnvStr("ZDG_DRIVE_CREDENTIALS", &d.Credentials)
+	loadEnvStr("ZDG_DRIVE_TOKEN_FILE", &d.TokenFile)
+	loadEnvStr("ZDG_DRIVE_IMPERSONATE", &d.Impersonate)
 	loadEnvStr("ZDG_DRIVE_FOLDER_NAME", &d.FolderName)
+	loadEnvStr("ZDG_DRIVE_SHARED_DRIVE_ID", &d.SharedDriveId)
+	loadEnvStr("ZDG_DRIVE_CONFLICT_POLICY", &d.ConflictPolicy)
+	loadEnvStr("ZDG_DRIVE_FOLDER_TEMPLATE", &d.FolderTemplate)
+	loadEnvStr("ZDG_DRIVE_FILE_TEMPLATE", &d.FileTemplate)
+	d.Sharing.loadFromEnv()
 }
 
 type clientConfig struct {
@@ -109,6 +251,13 @@ type clientConfig struct {
 	DryRun           bool     `yaml:"dry_run" json:"dry_run"`
 	Retry            uint     `yaml:"retry" json:"retry"`
 	UserIds          []string `yaml:"user_ids" json:"user_ids"`
+	MinDuration      uint     `yaml:"min_duration" json:"min_duration"`   // minutes
+	MinFileSize      uint     `yaml:"min_file_size" json:"min_file_size"` // bytes
+	DownloadWorkers  uint     `yaml:"download_workers" json:"download_workers"`
+	UploadWorkers    uint     `yaml:"upload_workers" json:"upload_workers"`
+	Stream           bool     `yaml:"stream" json:"stream"`             // pipe downloads into the destination without a local file
+	Destination      string   `yaml:"destination" json:"destination"`   // drive, local or s3
+	Destinations     []string `yaml:"destinations" json:"destinations"` // additional destinations every record is archived to
 }
 
 func defaultClientConfig() clientConfig {
@@ -122,6 +271,13 @@ func defaultClientConfig() clientConfig {
 		DryRun:           true,
 		Retry:            0,
 		UserIds:          []string{},
+		MinDuration:      0,
+		MinFileSize:      0,
+		DownloadWorkers:  1,
+		UploadWorkers:    1,
+		Stream:           false,
+		Destination:      DestinationDrive,
+		Destinations:     []string{},
 	}
 }
 
@@ -135,25 +291,164 @@ func (d *clientConfig) loadFromEnv() {
 	loadEnvBool("ZDG_CLIENT_DRY_RUN", &d.DryRun)
 	loadEnvUint("ZDG_CLIENT_Retry", &d.Retry)
 	loadEnvSliceOfString("ZDG_CLIENT_USER_IDS", &d.UserIds)
+	loadEnvUint("ZDG_CLIENT_MIN_DURATION", &d.MinDuration)
+	loadEnvUint("ZDG_CLIENT_MIN_FILE_SIZE", &d.MinFileSize)
+	loadEnvUint("ZDG_CLIENT_DOWNLOAD_WORKERS", &d.DownloadWorkers)
+	loadEnvUint("ZDG_CLIENT_UPLOAD_WORKERS", &d.UploadWorkers)
+	loadEnvBool("ZDG_CLIENT_STREAM", &d.Stream)
+	loadEnvStr("ZDG_CLIENT_DESTINATION", &d.Destination)
+	loadEnvSliceOfString("ZDG_CLIENT_DESTINATIONS", &d.Destinations)
+}
+
+type localConfig struct {
+	Path string `yaml:"path" json:"path"` // local or mounted network directory, holds the folder_name folders
+}
+
+func defaultLocalConfig() localConfig {
+	return localConfig{
+		Path: "./archive",
+	}
+}
+
+func (l *localConfig) loadFromEnv() {
+	loadEnvStr("ZDG_LOCAL_PATH", &l.Path)
+}
+
+type s3Config struct {
+	Endpoint        string `yaml:"endpoint" json:"endpoint"` // defaults to aws s3 of the region, set for minio, b2 or wasabi
+	Region          string `yaml:"region" json:"region"`
+	Bucket          string `yaml:"bucket" json:"bucket"`
+	Prefix          string `yaml:"prefix" json:"prefix"` // key prefix, holds the folder_name folders
+	AccessKeyId     string `yaml:"access_key_id" json:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key" json:"-"`
+	SessionToken    string `yaml:"session_token" json:"-"`
+	PathStyle       bool   `yaml:"path_style" json:"path_style"`       // bucket in the path instead of the host, needed by most minio setups
+	StorageClass    string `yaml:"storage_class" json:"storage_class"` // e.g. STANDARD_IA, GLACIER_IR
+	SSE             string `yaml:"sse" json:"sse"`                     // server side encryption, AES256 or aws:kms
+	SSEKmsKeyId     string `yaml:"sse_kms_key_id" json:"sse_kms_key_id"`
+	PartSize        uint   `yaml:"part_size" json:"part_size"` // multipart part size in MiB, at least 5
+}
+
+func defaultS3Config() s3Config {
+	return s3Config{
+		Region:   "us-east-1",
+		PartSize: 16,
+	}
+}
+
+func (s *s3Config) loadFromEnv() {
+	// the standard aws variables first, the specific ones win
+	loadEnvStr("AWS_REGION", &s.Region)
+	loadEnvStr("AWS_ACCESS_KEY_ID", &s.AccessKeyId)
+	loadEnvStr("AWS_SECRET_ACCESS_KEY", &s.SecretAccessKey)
+	loadEnvStr("AWS_SESSION_TOKEN", &s.SessionToken)
+	loadEnvStr("ZDG_S3_ENDPOINT", &s.Endpoint)
+	loadEnvStr("ZDG_S3_REGION", &s.Region)
+	loadEnvStr("ZDG_S3_BUCKET", &s.Bucket)
+	loadEnvStr("ZDG_S3_PREFIX", &s.Prefix)
+	loadEnvStr("ZDG_S3_ACCESS_KEY_ID", &s.AccessKeyId)
+	loadEnvStr("ZDG_S3_SECRET_ACCESS_KEY", &s.SecretAccessKey)
+	loadEnvStr("ZDG_S3_SESSION_TOKEN", &s.SessionToken)
+	loadEnvBool("ZDG_S3_PATH_STYLE", &s.PathStyle)
+	loadEnvStr("ZDG_S3_STORAGE_CLASS", &s.StorageClass)
+	loadEnvStr("ZDG_S3_SSE", &s.SSE)
+	loadEnvStr("ZDG_S3_SSE_KMS_KEY_ID", &s.SSEKmsKeyId)
+	loadEnvUint("ZDG_S3_PART_SIZE", &s.PartSize)
+}
+
+type webhookConfig struct {
+	Enabled     bool   `yaml:"enabled" json:"enabled"` // keep running after the sync and receive zoom webhooks
+	Listen      string `yaml:"listen" json:"listen"`
+	Path        string `yaml:"path" json:"path"`
+	SecretToken string `yaml:"secret_token" json:"-"` // secret token of the zoom webhook app
+}
+
+func defaultWebhookConfig() webhookConfig {
+	return webhookConfig{
+		Enabled: false,
+		Listen:  ":8080",
+		Path:    "/zoom/webhook",
+	}
+}
+
+func (w *webhookConfig) loadFromEnv() {
+	loadEnvBool("ZDG_WEBHOOK_ENABLED", &w.Enabled)
+	loadEnvStr("ZDG_WEBHOOK_LISTEN", &w.Listen)
+	loadEnvStr("ZDG_WEBHOOK_PATH", &w.Path)
+	loadEnvStr("ZDG_WEBHOOK_SECRET_TOKEN", &w.SecretToken)
+}
+
+type apiConfig struct {
+	Enabled bool   `yaml:"enabled" json:"enabled"` // keep running after the sync and serve the rest api
+	Listen  string `yaml:"listen" json:"listen"`
+	Token   string `yaml:"token" json:"-"` // bearer token of the api clients
+}
+
+func defaultAPIConfig() apiConfig {
+	return apiConfig{
+		Enabled: false,
+		Listen:  "127.0.0.1:8081",
+	}
+}
+
+func (a *apiConfig) loadFromEnv() {
+	loadEnvBool("ZDG_API_ENABLED", &a.Enabled)
+	loadEnvStr("ZDG_API_LISTEN", &a.Listen)
+	loadEnvStr("ZDG_API_TOKEN", &a.Token)
+}
+
+type daemonConfig struct {
+	Interval string `yaml:"interval" json:"interval"`   // time between sync cycles, e.g. 30m
+	Schedule string `yaml:"schedule" json:"schedule"`   // cron expression, wins over interval
+	LeaseTTL uint   `yaml:"lease_ttl" json:"lease_ttl"` // seconds a crashed instance blocks the others
+}
+
+func defaultDaemonConfig() daemonConfig {
+	return daemonConfig{
+		Interval: "1h",
+		Schedule: "",
+		LeaseTTL: 120,
+	}
+}
+
+func (d *daemonConfig) loadFromEnv() {
+	loadEnvStr("ZDG_DAEMON_INTERVAL", &d.Interval)
+	loadEnvStr("ZDG_DAEMON_SCHEDULE", &d.Schedule)
+	loadEnvUint("ZDG_DAEMON_LEASE_TTL", &d.LeaseTTL)
 }
 
 type config struct {
-	ZoomCfg   zoomConfig   `yaml:"zoom" json:"zoom"`
-	DriveCfg  driveConfig  `yaml:"drive" json:"drive"`
-	ClientCfg clientConfig `yaml:"client" json:"client"`
+	ZoomCfg    zoomConfig    `yaml:"zoom" json:"zoom"`
+	DriveCfg   driveConfig   `yaml:"drive" json:"drive"`
+	ClientCfg  clientConfig  `yaml:"client" json:"client"`
+	LocalCfg   localConfig   `yaml:"local" json:"local"`
+	S3Cfg      s3Config      `yaml:"s3" json:"s3"`
+	WebhookCfg webhookConfig `yaml:"webhook" json:"webhook"`
+	APICfg     apiConfig     `yaml:"api" json:"api"`
+	DaemonCfg  daemonConfig  `yaml:"daemon" json:"daemon"`
 }
 
 func (c *config) loadFromEnv() {
 	c.ZoomCfg.loadFromEnv()
 	c.DriveCfg.loadFromEnv()
 	c.ClientCfg.loadFromEnv()
+	c.LocalCfg.loadFromEnv()
+	c.S3Cfg.loadFromEnv()
+	c.WebhookCfg.loadFromEnv()
+	c.APICfg.loadFromEnv()
+	c.DaemonCfg.loadFromEnv()
 }
 
 func defaultConfig() config {
 	return config{
-		ZoomCfg:   defaultZoomConfig(),
-		DriveCfg:  defaultDriveConfig(),
-		ClientCfg: defaultClientConfig(),
+		ZoomCfg:    defaultZoomConfig(),
+		DriveCfg:   defaultDriveConfig(),
+		ClientCfg:  defaultClientConfig(),
+		LocalCfg:   defaultLocalConfig(),
+		S3Cfg:      defaultS3Config(),
+		WebhookCfg: defaultWebhookConfig(),
+		APICfg:     defaultAPIConfig(),
+		DaemonCfg:  defaultDaemonConfig(),
 	}
 }
 
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// syncLease is the lease name guarding fetch and sync cycles
+const syncLease = "sync"
+
+// errLeaseHeld reports another instance, or another cycle of this one,
+// processing the records
+var errLeaseHeld = errors.New("another sync holds the sync lease")
+
+// syncMu keeps the cycles of this process apart, they share instanceId and
+// acquiring the lease again as its owner succeeds
+var syncMu sync.Mutex
+
+// instanceId identifies this process as lease owner
+var instanceId = newInstanceId()
+
+func newInstanceId() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s:%d:%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// withSyncLease runs fn while holding the sync lease in the database, so
+// instances sharing the database never process the same records. The lease is
+// renewed while fn runs, ctx of fn is canceled when the lease is lost.
+func withSyncLease(ctx context.Context, cfg config, fn func(ctx context.Context) error) error {
+	ttl := time.Duration(cfg.DaemonCfg.LeaseTTL) * time.Second
+	if ttl < 30*time.Second {
+		ttl = 30 * time.Second
+	}
+
+	if !syncMu.TryLock() {
+		return errLeaseHeld
+	}
+	defer syncMu.Unlock()
+
+	ok, err := sqliteDatabase.AcquireLease(syncLease, instanceId, ttl)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errLeaseHeld
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				ok, err := sqliteDatabase.AcquireLease(syncLease, instanceId, ttl)
+				if err != nil {
+					// retried on the next tick, the lease outlives a few failures
+					log.Error().Err(err).Msg("Failed to renew sync lease")
+					continue
+				}
+				if !ok {
+					log.Error().Msg("Sync lease lost, stopping")
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	err = fn(ctx)
+
+	cancel()
+	wg.Wait()
+	if releaseErr := sqliteDatabase.ReleaseLease(syncLease, instanceId); releaseErr != nil {
+		log.Error().Err(releaseErr).Msg("Failed to release sync lease")
+	}
+	return err
+}
+
+// runCycle fetches the recordings from zoom when enabled and syncs them
+func runCycle(ctx context.Context, cfg config) error {
+	return withSyncLease(ctx, cfg, func(ctx context.Context) error {
+		if cfg.ClientCfg.FetchAPI {
+			err := fetchMeetings(ctx, cfg)
+			if ctx.Err() != nil {
+				log.Warn().Msg("Shutting down, zoom fetch interrupted")
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("get meeting record data: %w", err)
+			}
+		}
+		return syncRecords(ctx, cfg)
+	})
+}
+
+// runDaemon runs a cycle right away and then on the schedule until ctx is
+// done. A shutdown lets the running cycle finish its in-flight transfers,
+// interrupted downloads and uploads resume from their checkpoints.
+func runDaemon(ctx context.Context, cfg config) error {
+	schedule, err := NewSchedule(cfg.DaemonCfg)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	if cfg.WebhookCfg.Enabled || cfg.APICfg.Enabled {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := serveListeners(ctx, cfg)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to serve the http endpoints")
+			}
+		}()
+	}
+	defer wg.Wait()
+
+	log.Info().Str("instance", instanceId).Str("schedule", cfg.DaemonCfg.Schedule).Str("interval", cfg.DaemonCfg.Interval).Msg("Daemon started")
+	for {
+		start := time.Now()
+		err := runCycle(ctx, cfg)
+		switch {
+		case errors.Is(err, errLeaseHeld):
+			log.Info().Msg("Sync cycle skipped, another instance is running")
+		case err != nil:
+			log.Error().Err(err).Msg("Sync cycle failed")
+		default:
+			log.Info().Str("took", time.Since(start).Round(time.Second).String()).Msg("Sync cycle finished")
+		}
+
+		next := schedule.Next(time.Now())
+		if next.IsZero() {
+			return errors.New("daemon schedule has no next run")
+		}
+		log.Info().Time("next_run", next).Msg("Waiting for the next sync cycle")
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Info().Msg("Daemon stopped")
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// triggerRetryDelay is the wait before a triggered sync tries again to take
+// the lease held by a running cycle
+const triggerRetryDelay = 15 * time.Second
+
+// startSyncTrigger calls run whenever trigger is called until ctx is done.
+// Runs happen one at a time, triggers arriving during a run are coalesced into
+// the next one. A run finding the lease held is tried again once the holder
+// is done, so triggered records are never left for the next scheduled cycle.
+// done is closed once the last run returned.
+func startSyncTrigger(ctx context.Context, source string, run func(ctx context.Context) error) (trigger func(), done <-chan struct{}) {
+	triggers := make(chan struct{}, 1)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-triggers:
+				for {
+					err := run(ctx)
+					if !errors.Is(err, errLeaseHeld) {
+						if err != nil {
+							log.Error().Err(err).Str("source", source).Msg("Triggered sync failed")
+						}
+						break
+					}
+					// the running cycle may have listed the records before they arrived
+					log.Info().Str("source", source).Msg("Triggered sync waiting for the running sync")
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(triggerRetryDelay):
+					}
+				}
+			}
+		}
+	}()
+
+	trigger = func() {
+		select {
+		case triggers <- struct{}{}:
+		default:
+		}
+	}
+	return trigger, closed
+}
+
+// serveListeners serves the enabled webhook and api endpoints until ctx is
+// done, a failing server stops the others
+func serveListeners(ctx context.Context, cfg config) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	serve := func(fn func(ctx context.Context, cfg config) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := fn(ctx, cfg)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				cancel()
+			}
+		}()
+	}
+	if cfg.WebhookCfg.Enabled {
+		serve(serveWebhooks)
+	}
+	if cfg.APICfg.Enabled {
+		serve(serveAPI)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestStorage(t *testing.T) *SQLiteStorage {
+	t.Helper()
+	s, err := NewStorage("file:" + t.TempDir() + "/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.DB.Close() })
+	return s
+}
+
+func TestLease(t *testing.T) {
+	s := newTestStorage(t)
+
+	steps := []struct {
+		name  string
+		op    string // acquire or release
+		owner string
+		ttl   time.Duration
+		want  bool
+	}{
+		{"free lease", "acquire", "a", time.Minute, true},
+		{"owner renews", "acquire", "a", time.Minute, true},
+		{"held by another owner", "acquire", "b", time.Minute, false},
+		{"release by another owner is ignored", "release", "b", 0, false},
+		{"still held", "acquire", "b", time.Minute, false},
+		{"released by its owner", "release", "a", 0, false},
+		{"taken after release", "acquire", "b", -time.Minute, true},
+		{"taken once expired", "acquire", "a", time.Minute, true},
+		{"expired owner lost it", "acquire", "b", time.Minute, false},
+	}
+	for _, step := range steps {
+		switch step.op {
+		case "acquire":
+			ok, err := s.AcquireLease(syncLease, step.owner, step.ttl)
+			if err != nil {
+				t.Fatalf("%s: %v", step.name, err)
+			}
+			if ok != step.want {
+				t.Errorf("%s: AcquireLease(%q) = %t, want %t", step.name, step.owner, ok, step.want)
+			}
+		case "release":
+			err := s.ReleaseLease(syncLease, step.owner)
+			if err != nil {
+				t.Fatalf("%s: %v", step.name, err)
+			}
+		}
+	}
+}
+
+func TestWithSyncLease(t *testing.T) {
+	sqliteDatabase = newTestStorage(t)
+	ctx := context.Background()
+
+	err := withSyncLease(ctx, config{}, func(ctx context.Context) error {
+		// a nested cycle of the same process shares instanceId
+		err := withSyncLease(ctx, config{}, func(ctx context.Context) error { return nil })
+		if !errors.Is(err, errLeaseHeld) {
+			t.Errorf("nested withSyncLease = %v, want errLeaseHeld", err)
+		}
+		ok, err := sqliteDatabase.AcquireLease(syncLease, "other", time.Minute)
+		if err != nil || ok {
+			t.Errorf("AcquireLease by another instance = %t, %v, want held", ok, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := sqliteDatabase.AcquireLease(syncLease, "other", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("AcquireLease after withSyncLease = %t, %v, want released", ok, err)
+	}
+	err = withSyncLease(ctx, config{}, func(ctx context.Context) error {
+		t.Error("fn ran while another instance holds the lease")
+		return nil
+	})
+	if !errors.Is(err, errLeaseHeld) {
+		t.Errorf("withSyncLease = %v, want errLeaseHeld", err)
+	}
+}
@@ -5,17 +5,31 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
+// ErrNotFound reports a meeting or record missing from the database
+var ErrNotFound = errors.New("not found")
+
 type SQLiteStorage struct {
 	DB *sql.DB
 }
 
 // NewStorage creates new SQLite storage, creates tables if they don't exist
 func NewStorage(path string) (*SQLiteStorage, error) {
+	// the sync workers update records concurrently, wait for the write lock
+	// instead of failing with "database is locked"
+	if !strings.Contains(path, "_busy_timeout") {
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		path += sep + "_busy_timeout=10000"
+	}
+
 	sqliteDatabase, err := sql.Open("sqlite3", path)
 	if err != nil {
 		return nil, err
@@ -43,28 +57,102 @@ func NewStorage(path string) (*SQLiteStorage, error) {
 		playUrl TEXT,
 		status TEXT,
 		path TEXT
+	);
+	CREATE TABLE IF NOT EXISTS upload_sessions (
+		recordId TEXT PRIMARY KEY,
+		uri TEXT,
+		offset INTEGER,
+		createdAt TEXT
+	);
+	CREATE TABLE IF NOT EXISTS zoom_deletions (
+		recordId TEXT PRIMARY KEY,
+		meetingId TEXT,
+		action TEXT,
+		deletedAt TEXT
+	);
+	CREATE TABLE IF NOT EXISTS record_destinations (
+		recordId TEXT,
+		destination TEXT,
+		status TEXT,
+		remoteId TEXT NOT NULL DEFAULT '',
+		folderId TEXT NOT NULL DEFAULT '',
+		link TEXT NOT NULL DEFAULT '',
+		size INTEGER NOT NULL DEFAULT 0,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		lastError TEXT NOT NULL DEFAULT '',
+		updatedAt TEXT,
+		PRIMARY KEY (recordId, destination)
+	);
+	CREATE TABLE IF NOT EXISTS leases (
+		name TEXT PRIMARY KEY,
+		owner TEXT,
+		expiresAt INTEGER
+	);
+	CREATE TABLE IF NOT EXISTS drive_permissions (
+		permissionId TEXT,
+		fileId TEXT,
+		recordId TEXT,
+		type TEXT,
+		role TEXT,
+		target TEXT,
+		grantedAt TEXT,
+		revokedAt TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (fileId, permissionId)
 	);`
 	_, err = sqliteDatabase.ExecContext(context.Background(), q)
 	if err != nil {
 		return nil, err
 	}
 
+	err = migrate(sqliteDatabase)
+	if err != nil {
+		return nil, err
+	}
+
 	return &SQLiteStorage{DB: sqliteDatabase}, nil
 }
 
+// migrations add the columns introduced after the initial schema, applied
+// ones fail with a duplicate column error which is ignored
+var migrations = []string{
+	"ALTER TABLE `meetings` ADD COLUMN duration INTEGER",
+	"ALTER TABLE `meetings` ADD COLUMN hostId TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE `meetings` ADD COLUMN hostEmail TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE `records` ADD COLUMN downloadOffset INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE `records` ADD COLUMN md5 TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE `records` ADD COLUMN driveFileId TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE `records` ADD COLUMN driveFolderId TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE `records` ADD COLUMN webViewLink TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE `records` ADD COLUMN uploadedAt TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE `records` ADD COLUMN uploadedSize INTEGER NOT NULL DEFAULT 0",
+}
+
+func migrate(db *sql.DB) error {
+	for _, q := range migrations {
+		_, err := db.ExecContext(context.Background(), q)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return err
+		}
+	}
+	return nil
+}
+
 // SaveMeeting saves a meeting to the database
 func (s *SQLiteStorage) SaveMeeting(meeting Meeting) error {
 	// convert time to local
 	meeting.StartTime = meeting.StartTime.Local()
 
-	q := "INSERT INTO `meetings`(uuid, id, topic, startTime) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING"
+	q := "INSERT INTO `meetings`(uuid, id, topic, startTime, duration, hostId, hostEmail) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT(uuid) DO UPDATE SET duration = excluded.duration, hostId = excluded.hostId, hostEmail = IIF(excluded.hostEmail = '', hostEmail, excluded.hostEmail)"
 	log.Debug().Msg("Saving meeting")
 
 	_, err := s.DB.ExecContext(context.Background(), q,
 		meeting.UUID,                            // uuid
 		meeting.Id,                              // id
 		meeting.Topic,                           // topic
-		meeting.StartTime.Format(time.DateTime)) // startTime
+		meeting.StartTime.Format(time.DateTime), // startTime
+		meeting.Duration,                        // duration
+		meeting.HostId,                          // hostId
+		meeting.HostEmail)                       // hostEmail
 
 	if err != nil {
 		return err
@@ -88,7 +176,7 @@ func (s *SQLiteStorage) saveRecord(record Record) error {
 	// convert time to local
 	record.StartTime = record.StartTime.Local()
 
-	q := "INSERT INTO `records` VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) ON CONFLICT DO NOTHING"
+	q := "INSERT INTO `records`(id, meetingId, type, startTime, fileExtension, fileSize, downUrl, playUrl, status, path) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) ON CONFLICT DO NOTHING"
 	_, err := s.DB.ExecContext(context.Background(), q,
 		record.Id,                              // id
 		record.MeetingId,                       // meetingId
@@ -103,30 +191,11 @@ func (s *SQLiteStorage) saveRecord(record Record) error {
 	return err
 }
 
-// GetMeeting returns a meeting from the database
-func (s *SQLiteStorage) GetMeeting(UUID string) (*Meeting, error) {
-	q := "SELECT * FROM `meetings` WHERE uuid = $1"
-	row := s.DB.QueryRowContext(context.Background(), q, UUID)
-	meeting := Meeting{}
-	err := row.Scan(&meeting.UUID, &meeting.Id, &meeting.Topic, &meeting.DateTime)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, errors.New("aaaa")
-		}
-		return nil, err
-	}
-	return &meeting, nil
-}
-
-// GetRecords returns records of specific meeting from the database
-func (s *SQLiteStorage) GetRecords(UUID string) ([]Record, error) {
-	q := "SELECT * FROM `records` WHERE meetingId = $1"
-	rows, err := s.DB.QueryContext(context.Background(), q, UUID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+// recordColumns are the records columns in the order scanRecords expects them
+const recordColumns = "id, meetingId, type, startTime, fileExtension, fileSize, downUrl, playUrl, status, path, md5, driveFileId, driveFolderId, webViewLink, uploadedAt, uploadedSize"
 
+// scanRecords scans rows selected with recordColumns
+func scanRecords(rows *sql.Rows) ([]Record, error) {
 	var records []Record
 	for rows.Next() {
 		record := Record{}
@@ -140,26 +209,68 @@ func (s *SQLiteStorage) GetRecords(UUID string) ([]Record, error) {
 			&record.DownloadURL,
 			&record.PlayURL,
 			&record.Status,
-			&record.FilePath)
+			&record.FilePath,
+			&record.Md5,
+			&record.DriveFileId,
+			&record.DriveFolderId,
+			&record.WebViewLink,
+			&record.UploadedAt,
+			&record.UploadedSize)
 		if err != nil {
 			return nil, err
 		}
 		records = append(records, record)
 	}
-	return records, nil
+	return records, rows.Err()
 }
 
-func (s *SQLiteStorage) GetRecordsByFileExtensionAndRecordType(UUID string, recordType []string, fileExtension string) ([]Record, error) {
-	var str string
-	for i, value := range recordType {
-		str += "'" + value + "'"
-		if i < len(recordType)-1 {
-			str += ","
+// meetingColumns are the meetings columns in the order scanMeeting expects them
+const meetingColumns = "meetings.uuid, meetings.id, meetings.topic, meetings.startTime, IFNULL(meetings.duration, 0), meetings.hostId, meetings.hostEmail"
+
+// scanMeeting scans a row selected with meetingColumns
+func scanMeeting(row interface{ Scan(dest ...any) error }, meeting *Meeting) error {
+	return row.Scan(
+		&meeting.UUID,
+		&meeting.Id,
+		&meeting.Topic,
+		&meeting.DateTime,
+		&meeting.Duration,
+		&meeting.HostId,
+		&meeting.HostEmail,
+	)
+}
+
+// GetMeeting returns a meeting from the database
+func (s *SQLiteStorage) GetMeeting(UUID string) (*Meeting, error) {
+	q := "SELECT " + meetingColumns + " FROM `meetings` WHERE uuid = $1"
+	row := s.DB.QueryRowContext(context.Background(), q, UUID)
+	meeting := Meeting{}
+	err := scanMeeting(row, &meeting)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("meeting %s %w", UUID, ErrNotFound)
 		}
+		return nil, err
+	}
+	return &meeting, nil
+}
+
+// GetRecords returns records of specific meeting from the database
+func (s *SQLiteStorage) GetRecords(UUID string) ([]Record, error) {
+	q := "SELECT " + recordColumns + " FROM `records` WHERE meetingId = $1"
+	rows, err := s.DB.QueryContext(context.Background(), q, UUID)
+	if err != nil {
+		return nil, err
 	}
-	q := fmt.Sprintf("SELECT * FROM `records` WHERE meetingId = $1 AND fileExtension = $2 AND type IN (%s)", str)
+	defer rows.Close()
+
+	return scanRecords(rows)
+}
+
+func (s *SQLiteStorage) GetRecordsByFileExtensionAndRecordType(UUID string, recordType []string, fileExtension string) ([]Record, error) {
+	q := fmt.Sprintf("SELECT %s FROM `records` WHERE meetingId = $1 AND fileExtension = $2 AND type IN (%s)", recordColumns, sqlInList(recordType))
 	if len(recordType) == 0 {
-		q = "SELECT * FROM `records` WHERE meetingId = $1 AND fileExtension = $2"
+		q = "SELECT " + recordColumns + " FROM `records` WHERE meetingId = $1 AND fileExtension = $2"
 	}
 	log.Debug().Any("query", q).Msg("Find records by query")
 	rows, err := s.DB.QueryContext(context.Background(), q, UUID, fileExtension)
@@ -168,39 +279,13 @@ func (s *SQLiteStorage) GetRecordsByFileExtensionAndRecordType(UUID string, reco
 	}
 	defer rows.Close()
 
-	var records []Record
-	for rows.Next() {
-		record := Record{}
-		err := rows.Scan(
-			&record.Id,
-			&record.MeetingId,
-			&record.Type,
-			&record.DateTime,
-			&record.FileExtension,
-			&record.FileSize,
-			&record.DownloadURL,
-			&record.PlayURL,
-			&record.Status,
-			&record.FilePath)
-		if err != nil {
-			return nil, err
-		}
-		records = append(records, record)
-	}
-	return records, nil
+	return scanRecords(rows)
 }
 
 func (s *SQLiteStorage) GetUniqueMeetingByFileExtensionAndRecordType(fileExtension string, recordType []string, cutoff string) ([]Meeting, error) {
-	var str string
-	for i, value := range recordType {
-		str += "'" + value + "'"
-		if i < len(recordType)-1 {
-			str += ","
-		}
-	}
-	q := fmt.Sprintf("SELECT meetings.uuid, meetings.id, meetings.topic, meetings.startTime FROM `meetings` JOIN `records` ON meetings.uuid = records.meetingId WHERE meetings.startTime >= $1 AND records.status != 'synced' AND records.fileExtension = $2 AND records.type IN (%s) GROUP BY meetings.uuid ORDER BY meetings.startTime DESC;", str)
+	q := fmt.Sprintf("SELECT %s FROM `meetings` JOIN `records` ON meetings.uuid = records.meetingId WHERE meetings.startTime >= $1 AND records.status NOT IN ('synced', 'skipped', 'removed', 'corrupt') AND records.fileExtension = $2 AND records.type IN (%s) GROUP BY meetings.uuid ORDER BY meetings.startTime DESC;", meetingColumns, sqlInList(recordType))
 	if len(recordType) == 0 {
-		q = "SELECT meetings.uuid, meetings.id, meetings.topic, meetings.startTime FROM `meetings` JOIN `records` ON meetings.uuid = records.meetingId WHERE meetings.startTime >= $1 AND records.status != 'synced' AND records.fileExtension = $2 GROUP BY meetings.uuid ORDER BY meetings.startTime DESC;"
+		q = "SELECT " + meetingColumns + " FROM `meetings` JOIN `records` ON meetings.uuid = records.meetingId WHERE meetings.startTime >= $1 AND records.status NOT IN ('synced', 'skipped', 'removed', 'corrupt') AND records.fileExtension = $2 GROUP BY meetings.uuid ORDER BY meetings.startTime DESC;"
 	}
 	log.Debug().Any("query", q).Msg("Find meetings by query")
 	rows, err := s.DB.QueryContext(context.Background(), q, cutoff, fileExtension)
@@ -212,12 +297,7 @@ func (s *SQLiteStorage) GetUniqueMeetingByFileExtensionAndRecordType(fileExtensi
 	var meetings []Meeting
 	for rows.Next() {
 		meeting := Meeting{}
-		err := rows.Scan(
-			&meeting.UUID,
-			&meeting.Id,
-			&meeting.Topic,
-			&meeting.DateTime,
-		)
+		err := scanMeeting(rows, &meeting)
 		if err != nil {
 			return nil, err
 		}
@@ -231,40 +311,38 @@ func (s *SQLiteStorage) GetUniqueMeetingByFileExtensionAndRecordType(fileExtensi
 	return meetings, nil
 }
 
-// GetMeeting returns a meeting from the database
+// GetMeetingWithRecords returns a meeting with its records from the database
 func (s *SQLiteStorage) GetMeetingWithRecords(UUID string) (*Meeting, error) {
-	q := "SELECT meetings.uuid, meetings.id, meetings.topic, meetings.startTime, records.id, records.meetingId, records.type, records.startTime, records.fileExtension, records.fileSize, records.downUrl, records.playUrl, records.status  FROM `meetings` JOIN `records` ON meetings.uuid = records.meetingId WHERE meetings.uuid = $1"
-	rows, err := s.DB.Query(q, UUID)
+	meeting, err := s.GetMeeting(UUID)
+	if err != nil {
+		return nil, err
+	}
+	meeting.Records, err = s.GetRecords(meeting.UUID)
+	if err != nil {
+		return nil, err
+	}
+	return meeting, nil
+}
+
+// ListMeetings returns a page of the meetings, the newest first
+func (s *SQLiteStorage) ListMeetings(limit, offset int) ([]Meeting, error) {
+	q := "SELECT " + meetingColumns + " FROM `meetings` ORDER BY startTime DESC LIMIT $1 OFFSET $2"
+	rows, err := s.DB.QueryContext(context.Background(), q, limit, offset)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, errors.New("aaaa")
-		}
 		return nil, err
 	}
-	meeting := &Meeting{}
+	defer rows.Close()
+
+	var meetings []Meeting
 	for rows.Next() {
-		record := &Record{}
-		err = rows.Scan(
-			meeting.UUID,
-			meeting.Id,
-			meeting.Topic,
-			meeting.StartTime,
-			record.Id,
-			record.MeetingId,
-			record.Type,
-			record.StartTime,
-			record.FileExtension,
-			record.FileExtension,
-			record.DownloadURL,
-			record.PlayURL,
-			record.Status,
-		)
+		meeting := Meeting{}
+		err := scanMeeting(rows, &meeting)
 		if err != nil {
 			return nil, err
 		}
-		meeting.Records = append(meeting.Records, *record)
+		meetings = append(meetings, meeting)
 	}
-	return meeting, nil
+	return meetings, rows.Err()
 }
 
 // UpdateRecord updates a record in the database
@@ -274,21 +352,105 @@ func (s *SQLiteStorage) UpdateRecord(Id string, status RecordStatus) error {
 	return err
 }
 
-// ResetFailedRecords resets all failed records to queued
+// GetRecordDownloadOffset returns the bytes of the record already written to
+// its partial download file
+func (s *SQLiteStorage) GetRecordDownloadOffset(Id string) (int64, error) {
+	q := "SELECT downloadOffset FROM `records` WHERE id = $1"
+	var offset int64
+	err := s.DB.QueryRowContext(context.Background(), q, Id).Scan(&offset)
+	return offset, err
+}
+
+// UpdateRecordDownloadOffset stores the bytes of the record written to its
+// partial download file
+func (s *SQLiteStorage) UpdateRecordDownloadOffset(Id string, offset int64) error {
+	q := "UPDATE `records` SET downloadOffset = $1 WHERE id = $2"
+	_, err := s.DB.ExecContext(context.Background(), q, offset, Id)
+	return err
+}
+
+// UpdateRecordChecksum stores the hex md5 checksum of the downloaded record
+func (s *SQLiteStorage) UpdateRecordChecksum(Id string, md5 string) error {
+	q := "UPDATE `records` SET md5 = $1 WHERE id = $2"
+	_, err := s.DB.ExecContext(context.Background(), q, md5, Id)
+	return err
+}
+
+// UpdateRecordUpload stores where the record landed in its primary
+// destination, path is the destination path of the file
+func (s *SQLiteStorage) UpdateRecordUpload(Id string, path string, size int64) error {
+	q := "UPDATE `records` SET path = $1, uploadedAt = $2, uploadedSize = $3 WHERE id = $4"
+	_, err := s.DB.ExecContext(context.Background(), q, path, time.Now().Format(time.DateTime), size, Id)
+	return err
+}
+
+// UpdateRecordDriveFile stores the google drive file of the record, the files
+// of the other destinations are only kept in record_destinations
+func (s *SQLiteStorage) UpdateRecordDriveFile(Id string, file *RemoteFile) error {
+	q := "UPDATE `records` SET driveFileId = $1, driveFolderId = $2, webViewLink = $3 WHERE id = $4"
+	_, err := s.DB.ExecContext(context.Background(), q, file.Id, file.FolderId, file.Link, Id)
+	return err
+}
+
+// GetUploadSession returns the drive upload session of a record, nil when the
+// record has none
+func (s *SQLiteStorage) GetUploadSession(recordId string) (*UploadSession, error) {
+	q := "SELECT recordId, uri, offset, createdAt FROM `upload_sessions` WHERE recordId = $1"
+	session := UploadSession{}
+	var createdAt string
+	err := s.DB.QueryRowContext(context.Background(), q, recordId).Scan(&session.RecordId, &session.URI, &session.Offset, &createdAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	session.CreatedAt, err = time.ParseInLocation(time.DateTime, createdAt, time.Local)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// SaveUploadSession stores a new drive upload session of a record
+func (s *SQLiteStorage) SaveUploadSession(session UploadSession) error {
+	q := "INSERT OR REPLACE INTO `upload_sessions`(recordId, uri, offset, createdAt) VALUES ($1, $2, $3, $4)"
+	_, err := s.DB.ExecContext(context.Background(), q, session.RecordId, session.URI, session.Offset, session.CreatedAt.Format(time.DateTime))
+	return err
+}
+
+// UpdateUploadSessionOffset stores the bytes committed to a drive upload session
+func (s *SQLiteStorage) UpdateUploadSessionOffset(recordId string, offset int64) error {
+	q := "UPDATE `upload_sessions` SET offset = $1 WHERE recordId = $2"
+	_, err := s.DB.ExecContext(context.Background(), q, offset, recordId)
+	return err
+}
+
+// DeleteUploadSession removes the drive upload session of a record
+func (s *SQLiteStorage) DeleteUploadSession(recordId string) error {
+	q := "DELETE FROM `upload_sessions` WHERE recordId = $1"
+	_, err := s.DB.ExecContext(context.Background(), q, recordId)
+	return err
+}
+
+// ResetFailedRecords resets all failed records to queued, corrupt records
+// are only queued again by the retry and reset commands
 func (s *SQLiteStorage) ResetFailedRecords() error {
-	q := "UPDATE `records` SET status = 'queued' WHERE status !=  'synced'"
+	q := "UPDATE `records` SET status = 'queued' WHERE status NOT IN ('synced', 'skipped', 'removed', 'corrupt')"
 	_, err := s.DB.ExecContext(context.Background(), q)
 	return err
 }
 
-func (s *SQLiteStorage) CountRecordsByFileExtensionAndTypeAndStatus(fileExtension string, recordType RecordType, status RecordStatus) (uint, error) {
-	q := "SELECT COUNT(*) FROM `records` WHERE status =  $1 AND fileExtension = $2 AND type = $3"
-	if recordType == "all" {
-		q = "SELECT COUNT(*) FROM `records` WHERE status =  $1 AND fileExtension = $2"
+func (s *SQLiteStorage) CountUnsuccessSyncRecords(fileExtension string, recordType []string, cutoff string) (uint, error) {
+	q := fmt.Sprintf("SELECT COUNT(*) FROM `records` WHERE startTime >= $1 AND status NOT IN ('synced', 'skipped', 'removed', 'corrupt') AND fileExtension = $2 AND type IN (%s)", sqlInList(recordType))
+	if len(recordType) == 0 {
+		q = "SELECT COUNT(*) FROM `records` WHERE startTime >= $1 AND status NOT IN ('synced', 'skipped', 'removed', 'corrupt') AND fileExtension = $2"
 	}
 
+	log.Debug().Any("query", q).Msg("Find previously unsuccess meetings by query")
+
 	var count uint
-	rows, err := s.DB.Query(q, status, fileExtension, recordType)
+	rows, err := s.DB.Query(q, cutoff, fileExtension)
 	if err != nil {
 		return count, err
 	}
@@ -301,32 +463,423 @@ func (s *SQLiteStorage) CountRecordsByFileExtensionAndTypeAndStatus(fileExtensio
 	return count, err
 }
 
-func (s *SQLiteStorage) CountUnsuccessSyncRecords(fileExtension string, recordType []string, cutoff string) (uint, error) {
+// sqlInList quotes the values for use in an IN clause
+func sqlInList(values []string) string {
 	var str string
-	for i, value := range recordType {
-		str += "'" + value + "'"
-		if i < len(recordType)-1 {
+	for i, value := range values {
+		str += "'" + strings.ReplaceAll(value, "'", "''") + "'"
+		if i < len(values)-1 {
 			str += ","
 		}
 	}
+	return str
+}
 
-	q := fmt.Sprintf("SELECT COUNT(*) FROM `records` WHERE startTime >= $1 AND status != 'synced' AND fileExtension = $2 AND type IN (%s)", str)
-	if len(recordType) == 0 {
-		q = "SELECT COUNT(*) FROM `records` WHERE startTime >= $1 AND status != 'synced' AND fileExtension = $2"
+// GetMeetingsPendingZoomDeletion returns the meetings whose selected records are
+// all synced or skipped, with the synced records not yet deleted from zoom
+func (s *SQLiteStorage) GetMeetingsPendingZoomDeletion(fileExtension string, recordType []string, cutoff string) ([]Meeting, error) {
+	typeFilter := ""
+	if len(recordType) > 0 {
+		typeFilter = fmt.Sprintf("AND records.type IN (%s)", sqlInList(recordType))
 	}
+	q := fmt.Sprintf("SELECT %s FROM `meetings` JOIN `records` ON meetings.uuid = records.meetingId WHERE meetings.startTime >= $1 AND records.fileExtension = $2 %s GROUP BY meetings.uuid HAVING SUM(records.status NOT IN ('synced', 'skipped', 'removed')) = 0 AND SUM(records.status = 'synced' AND records.id NOT IN (SELECT recordId FROM `zoom_deletions`)) > 0 ORDER BY meetings.startTime DESC;", meetingColumns, typeFilter)
+	log.Debug().Any("query", q).Msg("Find meetings pending zoom deletion by query")
+	rows, err := s.DB.QueryContext(context.Background(), q, cutoff, fileExtension)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	log.Debug().Any("query", q).Msg("Find previously unsuccess meetings by query")
+	var meetings []Meeting
+	for rows.Next() {
+		meeting := Meeting{}
+		err := scanMeeting(rows, &meeting)
+		if err != nil {
+			return nil, err
+		}
+		meetings = append(meetings, meeting)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range meetings {
+		records, err := s.GetRecordsByFileExtensionAndRecordType(meetings[i].UUID, recordType, fileExtension)
+		if err != nil {
+			return nil, err
+		}
+		pending := records[:0]
+		for _, r := range records {
+			if r.Status != Synced {
+				continue
+			}
+			deleted, err := s.IsZoomRecordingDeleted(r.Id)
+			if err != nil {
+				return nil, err
+			}
+			if !deleted {
+				pending = append(pending, r)
+			}
+		}
+		meetings[i].Records = pending
+	}
+	return meetings, nil
+}
 
+// IsZoomRecordingDeleted reports whether the record was deleted from zoom
+func (s *SQLiteStorage) IsZoomRecordingDeleted(recordId string) (bool, error) {
+	q := "SELECT COUNT(*) FROM `zoom_deletions` WHERE recordId = $1"
 	var count uint
-	rows, err := s.DB.Query(q, cutoff, fileExtension)
+	err := s.DB.QueryRowContext(context.Background(), q, recordId).Scan(&count)
+	return count > 0, err
+}
+
+// SaveZoomDeletion records that a record was deleted from zoom
+func (s *SQLiteStorage) SaveZoomDeletion(recordId, meetingId, action string) error {
+	q := "INSERT INTO `zoom_deletions`(recordId, meetingId, action, deletedAt) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING"
+	_, err := s.DB.ExecContext(context.Background(), q, recordId, meetingId, action, time.Now().Format(time.DateTime))
+	return err
+}
+
+// SkipRecordsBelowLimits marks the queued and failed records of meetings shorter
+// than minDuration minutes or smaller than minFileSize bytes as skipped, and
+// queues skipped records again which pass the limits. Meetings saved before
+// their duration was stored are never skipped by duration, skipped records
+// deleted from zoom stay skipped.
+func (s *SQLiteStorage) SkipRecordsBelowLimits(fileExtension string, recordType []string, minDuration, minFileSize uint) (int64, error) {
+	typeFilter := ""
+	if len(recordType) > 0 {
+		typeFilter = fmt.Sprintf("AND type IN (%s)", sqlInList(recordType))
+	}
+	below := "(meetingId IN (SELECT uuid FROM `meetings` WHERE duration IS NOT NULL AND duration < $1) OR fileSize < $2)"
+
+	q := fmt.Sprintf("UPDATE `records` SET status = 'skipped' WHERE %s AND status IN ('queued', 'failed') AND fileExtension = $3 %s", below, typeFilter)
+	log.Debug().Any("query", q).Msg("Skip records by query")
+	res, err := s.DB.ExecContext(context.Background(), q, minDuration, minFileSize, fileExtension)
 	if err != nil {
-		return count, err
+		return 0, err
+	}
+	skipped, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	q = fmt.Sprintf("UPDATE `records` SET status = 'queued' WHERE NOT %s AND status = 'skipped' AND fileExtension = $3 %s AND id NOT IN (SELECT recordId FROM `zoom_deletions`)", below, typeFilter)
+	_, err = s.DB.ExecContext(context.Background(), q, minDuration, minFileSize, fileExtension)
+	return skipped, err
+}
+
+// GetSkippedRecordsPendingZoomDeletion returns the skipped records not yet
+// deleted from zoom
+func (s *SQLiteStorage) GetSkippedRecordsPendingZoomDeletion() ([]Record, error) {
+	q := "SELECT " + recordColumns + " FROM `records` WHERE status = 'skipped' AND id NOT IN (SELECT recordId FROM `zoom_deletions`)"
+	rows, err := s.DB.QueryContext(context.Background(), q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanRecords(rows)
+}
+
+// SaveDrivePermission records a permission granted on the drive file of a record
+func (s *SQLiteStorage) SaveDrivePermission(p DrivePermission) error {
+	q := "INSERT INTO `drive_permissions`(permissionId, fileId, recordId, type, role, target, grantedAt) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT DO UPDATE SET role = excluded.role, revokedAt = ''"
+	_, err := s.DB.ExecContext(context.Background(), q, p.Id, p.FileId, p.RecordId, p.Type, p.Role, p.Target, time.Now().Format(time.DateTime))
+	return err
+}
+
+// GetDrivePermissions returns the permissions granted on the drive file of a
+// record, revoked ones included
+func (s *SQLiteStorage) GetDrivePermissions(recordId string) ([]DrivePermission, error) {
+	q := "SELECT permissionId, fileId, recordId, type, role, target, grantedAt, revokedAt FROM `drive_permissions` WHERE recordId = $1 ORDER BY grantedAt"
+	rows, err := s.DB.QueryContext(context.Background(), q, recordId)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
+	var perms []DrivePermission
 	for rows.Next() {
-		if err := rows.Scan(&count); err != nil {
-			return count, err
+		var p DrivePermission
+		err := rows.Scan(&p.Id, &p.FileId, &p.RecordId, &p.Type, &p.Role, &p.Target, &p.GrantedAt, &p.RevokedAt)
+		if err != nil {
+			return nil, err
 		}
+		perms = append(perms, p)
 	}
-	return count, err
+	return perms, rows.Err()
+}
+
+// RevokeDrivePermission marks a granted permission as revoked
+func (s *SQLiteStorage) RevokeDrivePermission(fileId, permissionId string) error {
+	q := "UPDATE `drive_permissions` SET revokedAt = $1 WHERE fileId = $2 AND permissionId = $3"
+	_, err := s.DB.ExecContext(context.Background(), q, time.Now().Format(time.DateTime), fileId, permissionId)
+	return err
+}
+
+// GetRecordDestinations returns the sync state of the record per destination
+func (s *SQLiteStorage) GetRecordDestinations(recordId string) ([]RecordDestination, error) {
+	q := "SELECT recordId, destination, status, remoteId, folderId, link, size, attempts, lastError, updatedAt FROM `record_destinations` WHERE recordId = $1 ORDER BY destination"
+	rows, err := s.DB.QueryContext(context.Background(), q, recordId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dests []RecordDestination
+	for rows.Next() {
+		var d RecordDestination
+		err := rows.Scan(&d.RecordId, &d.Destination, &d.Status, &d.RemoteId, &d.FolderId, &d.Link, &d.Size, &d.Attempts, &d.LastError, &d.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		dests = append(dests, d)
+	}
+	return dests, rows.Err()
+}
+
+// StartRecordDestination marks the record uploading to the destination and
+// counts the attempt
+func (s *SQLiteStorage) StartRecordDestination(recordId, destination string) error {
+	q := "INSERT INTO `record_destinations`(recordId, destination, status, attempts, updatedAt) VALUES ($1, $2, $3, 1, $4) ON CONFLICT DO UPDATE SET status = excluded.status, attempts = attempts + 1, updatedAt = excluded.updatedAt"
+	_, err := s.DB.ExecContext(context.Background(), q, recordId, destination, Uploading, time.Now().Format(time.DateTime))
+	return err
+}
+
+// FailRecordDestination stores the failed or corrupt status and the error of
+// the last attempt
+func (s *SQLiteStorage) FailRecordDestination(recordId, destination string, status RecordStatus, cause error) error {
+	q := "UPDATE `record_destinations` SET status = $1, lastError = $2, updatedAt = $3 WHERE recordId = $4 AND destination = $5"
+	_, err := s.DB.ExecContext(context.Background(), q, status, cause.Error(), time.Now().Format(time.DateTime), recordId, destination)
+	return err
+}
+
+// SyncRecordDestination stores the file of the record in the destination
+func (s *SQLiteStorage) SyncRecordDestination(recordId, destination string, file *RemoteFile) error {
+	q := "UPDATE `record_destinations` SET status = $1, remoteId = $2, folderId = $3, link = $4, size = $5, lastError = '', updatedAt = $6 WHERE recordId = $7 AND destination = $8"
+	_, err := s.DB.ExecContext(context.Background(), q, Synced, file.Id, file.FolderId, file.Link, file.Size, time.Now().Format(time.DateTime), recordId, destination)
+	return err
+}
+
+// RemoveZoomRecords handles recordings trashed or deleted in zoom, all records
+// of the meeting when recordIds is empty. Unsynced records are never synced,
+// synced and skipped ones are left out of the zoom cleanup.
+func (s *SQLiteStorage) RemoveZoomRecords(meetingUUID string, recordIds []string, action string) (int64, error) {
+	idFilter := ""
+	if len(recordIds) > 0 {
+		idFilter = fmt.Sprintf("AND id IN (%s)", sqlInList(recordIds))
+	}
+
+	q := fmt.Sprintf("INSERT INTO `zoom_deletions`(recordId, meetingId, action, deletedAt) SELECT id, meetingId, $1, $2 FROM `records` WHERE meetingId = $3 %s AND status IN ('synced', 'skipped') ON CONFLICT DO NOTHING", idFilter)
+	_, err := s.DB.ExecContext(context.Background(), q, action, time.Now().Format(time.DateTime), meetingUUID)
+	if err != nil {
+		return 0, err
+	}
+
+	q = fmt.Sprintf("UPDATE `records` SET status = 'removed' WHERE meetingId = $1 %s AND status NOT IN ('synced', 'skipped')", idFilter)
+	res, err := s.DB.ExecContext(context.Background(), q, meetingUUID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// RecoverZoomRecords queues the removed records of a meeting recovered from the
+// zoom trash again
+func (s *SQLiteStorage) RecoverZoomRecords(meetingUUID string, recordIds []string) (int64, error) {
+	idFilter := ""
+	if len(recordIds) > 0 {
+		idFilter = fmt.Sprintf("AND id IN (%s)", sqlInList(recordIds))
+	}
+
+	q := fmt.Sprintf("DELETE FROM `zoom_deletions` WHERE action = 'trash' AND recordId IN (SELECT id FROM `records` WHERE meetingId = $1 %s)", idFilter)
+	_, err := s.DB.ExecContext(context.Background(), q, meetingUUID)
+	if err != nil {
+		return 0, err
+	}
+
+	q = fmt.Sprintf("UPDATE `records` SET status = 'queued' WHERE meetingId = $1 %s AND status = 'removed'", idFilter)
+	res, err := s.DB.ExecContext(context.Background(), q, meetingUUID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// AcquireLease takes or renews the named lease for ttl, it reports false while
+// another owner holds an unexpired lease
+func (s *SQLiteStorage) AcquireLease(name, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	q := "INSERT INTO `leases`(name, owner, expiresAt) VALUES ($1, $2, $3) ON CONFLICT(name) DO UPDATE SET owner = excluded.owner, expiresAt = excluded.expiresAt WHERE leases.owner = excluded.owner OR leases.expiresAt < $4"
+	res, err := s.DB.ExecContext(context.Background(), q, name, owner, now.Add(ttl).Unix(), now.Unix())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ReleaseLease gives up the named lease if owner holds it
+func (s *SQLiteStorage) ReleaseLease(name, owner string) error {
+	q := "DELETE FROM `leases` WHERE name = $1 AND owner = $2"
+	_, err := s.DB.ExecContext(context.Background(), q, name, owner)
+	return err
+}
+
+// GetRecord returns a record from the database
+func (s *SQLiteStorage) GetRecord(Id string) (*Record, error) {
+	q := "SELECT " + recordColumns + " FROM `records` WHERE id = $1"
+	rows, err := s.DB.QueryContext(context.Background(), q, Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records, err := scanRecords(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("record %s %w", Id, ErrNotFound)
+	}
+	return &records[0], nil
+}
+
+// RecordFilter selects records, empty fields match all
+type RecordFilter struct {
+	Statuses      []string
+	Types         []string
+	FileExtension string
+	Hosts         []string // zoom host ids or emails
+	Since         string   // oldest record start time
+	Until         string   // newest record start time, exclusive
+	Limit         int
+}
+
+// ListRecords returns the records matching the filter, the newest first
+func (s *SQLiteStorage) ListRecords(filter RecordFilter) ([]Record, error) {
+	var where []string
+	var args []any
+	if len(filter.Statuses) > 0 {
+		where = append(where, fmt.Sprintf("status IN (%s)", sqlInList(filter.Statuses)))
+	}
+	if len(filter.Types) > 0 {
+		where = append(where, fmt.Sprintf("type IN (%s)", sqlInList(filter.Types)))
+	}
+	if filter.FileExtension != "" {
+		args = append(args, filter.FileExtension)
+		where = append(where, fmt.Sprintf("fileExtension = $%d", len(args)))
+	}
+	if len(filter.Hosts) > 0 {
+		hosts := make([]string, len(filter.Hosts))
+		for i, host := range filter.Hosts {
+			hosts[i] = strings.ToLower(host)
+		}
+		in := sqlInList(hosts)
+		where = append(where, fmt.Sprintf("meetingId IN (SELECT uuid FROM `meetings` WHERE LOWER(hostId) IN (%s) OR LOWER(hostEmail) IN (%s))", in, in))
+	}
+	if filter.Since != "" {
+		args = append(args, filter.Since)
+		where = append(where, fmt.Sprintf("startTime >= $%d", len(args)))
+	}
+	if filter.Until != "" {
+		args = append(args, filter.Until)
+		where = append(where, fmt.Sprintf("startTime < $%d", len(args)))
+	}
+
+	q := "SELECT " + recordColumns + " FROM `records`"
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY startTime DESC"
+	if filter.Limit > 0 {
+		q += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+	log.Debug().Any("query", q).Msg("List records by query")
+
+	rows, err := s.DB.QueryContext(context.Background(), q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanRecords(rows)
+}
+
+// RecordCount is the number and size of the records of a status, type and
+// extension
+type RecordCount struct {
+	Status        RecordStatus `json:"status"`
+	Type          RecordType   `json:"recording_type"`
+	FileExtension string       `json:"file_extension"`
+	Count         uint         `json:"count"`
+	Size          FileSize     `json:"size"`
+}
+
+// CountRecordsGrouped counts the records per status, type and extension
+func (s *SQLiteStorage) CountRecordsGrouped() ([]RecordCount, error) {
+	q := "SELECT status, type, fileExtension, COUNT(*), IFNULL(SUM(fileSize), 0) FROM `records` GROUP BY status, type, fileExtension ORDER BY status, type, fileExtension"
+	rows, err := s.DB.QueryContext(context.Background(), q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []RecordCount
+	for rows.Next() {
+		var c RecordCount
+		err := rows.Scan(&c.Status, &c.Type, &c.FileExtension, &c.Count, &c.Size)
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// ResetRecords queues the records with the statuses again
+func (s *SQLiteStorage) ResetRecords(statuses []string) (int64, error) {
+	if len(statuses) == 0 {
+		return 0, nil
+	}
+	q := fmt.Sprintf("UPDATE `records` SET status = 'queued' WHERE status IN (%s)", sqlInList(statuses))
+	res, err := s.DB.ExecContext(context.Background(), q)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ForgetMeeting deletes a meeting with its records and their sync state, the
+// zoom deletions and drive permissions are kept for auditing
+func (s *SQLiteStorage) ForgetMeeting(UUID string) (int64, error) {
+	tx, err := s.DB.BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, q := range []string{
+		"DELETE FROM `record_destinations` WHERE recordId IN (SELECT id FROM `records` WHERE meetingId = $1)",
+		"DELETE FROM `upload_sessions` WHERE recordId IN (SELECT id FROM `records` WHERE meetingId = $1)",
+	} {
+		_, err := tx.ExecContext(context.Background(), q, UUID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	res, err := tx.ExecContext(context.Background(), "DELETE FROM `records` WHERE meetingId = $1", UUID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(context.Background(), "DELETE FROM `meetings` WHERE uuid = $1", UUID)
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
 }
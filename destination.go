@@ -0,0 +1,204 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// Destination is a storage the records are archived to
+type Destination interface {
+	// Name identifies the destination kind in logs
+	Name() string
+	// EnsureFolder returns the id of the folder path below the destination
+	// root, creating the missing folders
+	EnsureFolder(folders []string) (string, error)
+	// Upload stores the content of r as filename in the folder. The reader
+	// is not required to be seekable, a *os.File may be uploaded resumably.
+	Upload(record Record, folderId, filename string, r io.Reader) (*RemoteFile, error)
+	// Stat returns the stored file with the id
+	Stat(id string) (*RemoteFile, error)
+	// Delete removes the stored file with the id
+	Delete(id string) error
+}
+
+// RemoteFile is a record file stored in a destination
+type RemoteFile struct {
+	Id       string
+	FolderId string
+	Name     string
+	Size     int64
+	Md5      string // hex md5 checksum
+	Link     string // where a user opens the file
+	Existed  bool   // kept by the skip conflict policy, never deleted by the sync
+}
+
+// destination kinds
+const (
+	DestinationDrive = "drive"
+	DestinationLocal = "local"
+	DestinationS3    = "s3"
+)
+
+func validDestination(kind string) bool {
+	return kind == DestinationDrive || kind == DestinationLocal || kind == DestinationS3
+}
+
+// recordFileName adds the record id to filename, it keeps apart the records
+// whose rendered names collide in destinations without duplicate names
+func recordFileName(filename string, record Record) string {
+	ext := path.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "-" + formatFolderName(record.Id) + ext
+}
+
+// destinations builds the destinations of a route once and keeps them for the
+// following records of the route
+type destinations struct {
+	cfg   config
+	dests map[string]Destination
+	s3    *S3Client // shared by the s3 routes
+}
+
+func newDestinations(cfg config) *destinations {
+	return &destinations{cfg: cfg, dests: map[string]Destination{}}
+}
+
+// get returns the destinations of the route, the primary one first
+func (d *destinations) get(route Route) ([]Destination, error) {
+	var dests []Destination
+	for _, kind := range route.Destinations {
+		dest, err := d.build(route, kind)
+		if err != nil {
+			return nil, err
+		}
+		dests = append(dests, dest)
+	}
+	return dests, nil
+}
+
+func (d *destinations) build(route Route, kind string) (Destination, error) {
+	key := route.Name + "/" + kind
+	if dest, ok := d.dests[key]; ok {
+		return dest, nil
+	}
+
+	var dest Destination
+	policy := ConflictPolicy(d.cfg.DriveCfg.ConflictPolicy)
+	switch kind {
+	case DestinationLocal:
+		dest = NewLocalDestination(d.cfg.LocalCfg.Path, route.FolderName, policy)
+	case DestinationS3:
+		if d.s3 == nil {
+			client, err := NewS3Client(d.cfg.S3Cfg)
+			if err != nil {
+				return nil, err
+			}
+			d.s3 = client
+		}
+		dest = NewS3Destination(d.s3, route.FolderName, policy)
+	default:
+		dest = NewDriveDestination(route.SharedDriveId, route.FolderName, policy)
+	}
+	d.dests[key] = dest
+	return dest, nil
+}
+
+// DriveDestination stores records in google drive below the folder_name
+// folder of my drive or of a shared drive
+type DriveDestination struct {
+	driveId    string
+	folderName string
+	policy     ConflictPolicy
+
+	mx     sync.Mutex
+	rootId string
+}
+
+func NewDriveDestination(driveId, folderName string, policy ConflictPolicy) *DriveDestination {
+	return &DriveDestination{driveId: driveId, folderName: folderName, policy: policy}
+}
+
+func (d *DriveDestination) Name() string {
+	return DestinationDrive
+}
+
+// root resolves the folder_name folder once, "/" nests folders
+func (d *DriveDestination) root() (string, error) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if d.rootId != "" {
+		return d.rootId, nil
+	}
+	rootId, err := CreateFolderPathIfNotExists(d.driveId, strings.FieldsFunc(d.folderName, func(r rune) bool { return r == '/' }), "")
+	if err != nil {
+		return "", err
+	}
+	if rootId == "" {
+		// no folder name, store directly in the root of the shared drive
+		rootId = d.driveId
+	}
+	d.rootId = rootId
+	return rootId, nil
+}
+
+func (d *DriveDestination) EnsureFolder(folders []string) (string, error) {
+	rootId, err := d.root()
+	if err != nil {
+		return "", err
+	}
+	return CreateFolderPathIfNotExists(d.driveId, folders, rootId)
+}
+
+func (d *DriveDestination) Upload(record Record, folderId, filename string, r io.Reader) (*RemoteFile, error) {
+	existing, fileId, err := resolveConflict(d.driveId, folderId, record, d.policy)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		rf := driveRemoteFile(existing)
+		rf.Existed = true
+		return rf, nil
+	}
+
+	var file *drive.File
+	if f, ok := r.(*os.File); ok {
+		file, err = Upload(record, folderId, fileId, f, filename)
+	} else {
+		file, err = UploadReader(driveService, record, folderId, fileId, filename, r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return driveRemoteFile(file), nil
+}
+
+func (d *DriveDestination) Stat(id string) (*RemoteFile, error) {
+	file, err := driveService.Files.Get(id).SupportsAllDrives(true).Fields(uploadedFileFields).Do()
+	if err != nil {
+		return nil, err
+	}
+	return driveRemoteFile(file), nil
+}
+
+func (d *DriveDestination) Delete(id string) error {
+	return DeleteFile(id)
+}
+
+func driveRemoteFile(file *drive.File) *RemoteFile {
+	rf := &RemoteFile{
+		Id:   file.Id,
+		Name: file.Name,
+		Size: file.Size,
+		Md5:  file.Md5Checksum,
+		Link: file.WebViewLink,
+	}
+	if len(file.Parents) > 0 {
+		rf.FolderId = file.Parents[0]
+	}
+	return rf
+}
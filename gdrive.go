@@ -4,43 +4,39 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/rs/zerolog/log"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
-	"golang.org/x/oauth2/jwt"
 	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 )
 
-func ServiceAccount(credentialFile string) *http.Client {
+// ServiceAccount returns a client authorized as the service account of the
+// credential file, impersonating subject through domain-wide delegation when
+// subject is not empty
+func ServiceAccount(credentialFile, subject string) *http.Client {
 	b, err := os.ReadFile(credentialFile)
 	if err != nil {
-		log.Fatal().Err(err)
-	}
-	var c = struct {
-		Email      string `json:"client_email"`
-		PrivateKey string `json:"private_key"`
-	}{}
-	json.Unmarshal(b, &c)
-	config := &jwt.Config{
-		Email:      c.Email,
-		PrivateKey: []byte(c.PrivateKey),
-		Scopes: []string{
-			drive.DriveScope,
-		},
-		TokenURL: google.JWTTokenURL,
+		log.Fatal().Err(err).Msg("Unable to read service account file")
 	}
+	config, err := google.JWTConfigFromJSON(b, drive.DriveScope)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to parse service account file to config")
+	}
+	config.Subject = subject
 	client := config.Client(context.Background())
 	return client
 }
 
 // Retrieves a token, saves the token, then returns the generated client.
-func GetClient(config *oauth2.Config) *http.Client {
-	tokFile := "token.json"
+func GetClient(config *oauth2.Config, tokFile string) *http.Client {
 	tok, err := tokenFromFile(tokFile)
 	if err != nil {
 		tok = getTokenFromWeb(config)
@@ -97,18 +93,48 @@ func saveToken(path string, token *oauth2.Token) {
 	}
 }
 
-func NewDriveService(ctx context.Context) (*drive.Service, error) {
-	b, err := os.ReadFile("credentials.json")
-	if err != nil {
-		log.Fatal().Err(err).Msg("Unable to read client secret file")
-	}
+// DriveAuth describes how z2gd authenticates against google drive
+type DriveAuth string
 
-	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.ConfigFromJSON(b, drive.DriveScope)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Unable to parse client secret file to config")
+const (
+	AuthOAuth          DriveAuth = "oauth"           // installed app oauth with a cached user token
+	AuthServiceAccount DriveAuth = "service_account" // service account json key
+	AuthDelegation     DriveAuth = "delegation"      // service account impersonating a user of the domain
+)
+
+// uploadedFileFields are the fields requested for an uploaded file
+const uploadedFileFields = "id, name, parents, size, md5Checksum, webViewLink"
+
+// driveHTTPClient is the authorized client behind driveService, used for the
+// resumable upload protocol the drive library does not expose
+var driveHTTPClient *http.Client
+
+func NewDriveService(ctx context.Context, cfg driveConfig) (*drive.Service, error) {
+	var client *http.Client
+	switch DriveAuth(cfg.Auth) {
+	case AuthServiceAccount:
+		client = ServiceAccount(cfg.Credentials, "")
+	case AuthDelegation:
+		if cfg.Impersonate == "" {
+			log.Fatal().Msg("Domain-wide delegation needs drive.impersonate")
+		}
+		client = ServiceAccount(cfg.Credentials, cfg.Impersonate)
+	case AuthOAuth, "":
+		b, err := os.ReadFile(cfg.Credentials)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Unable to read client secret file")
+		}
+
+		// If modifying these scopes, delete your previously saved token.json.
+		config, err := google.ConfigFromJSON(b, drive.DriveScope)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Unable to parse client secret file to config")
+		}
+		client = GetClient(config, cfg.TokenFile)
+	default:
+		return nil, fmt.Errorf("unknown drive auth %q", cfg.Auth)
 	}
-	client := GetClient(config)
+	driveHTTPClient = client
 
 	srv, err := drive.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
@@ -118,46 +144,171 @@ func NewDriveService(ctx context.Context) (*drive.Service, error) {
 	return srv, nil
 }
 
-func Upload(srv *drive.Service, parentFolderId, filepath, filename string) error {
+// ConflictPolicy decides what happens to a record already uploaded to drive
+type ConflictPolicy string
+
+const (
+	ConflictSkip     ConflictPolicy = "skip"     // keep the existing file
+	ConflictReplace  ConflictPolicy = "replace"  // delete the existing file and upload a new one
+	ConflictRevision ConflictPolicy = "revision" // upload a new revision of the existing file
+)
+
+// app properties tagging uploaded files with their zoom origin
+const (
+	appPropertyRecordId    = "zoomRecordId"
+	appPropertyMeetingUUID = "zoomMeetingUuid"
+)
+
+func recordAppProperties(record Record) map[string]string {
+	return map[string]string{
+		appPropertyRecordId:    record.Id,
+		appPropertyMeetingUUID: record.MeetingId,
+	}
+}
+
+// Upload uploads the local file as filename into the folderId folder, or as a
+// new revision of fileId when set
+func Upload(record Record, folderId, fileId string, file *os.File, filename string) (*drive.File, error) {
 	// baseMimeType := "text/plain"
-	file, err := os.Open(filepath + filename)
+	f := &drive.File{Name: filename, AppProperties: recordAppProperties(record)}
+	if fileId == "" {
+		f.Parents = []string{folderId}
+	}
+	res, err := ResumableUpload(driveHTTPClient, record.Id, fileId, f, file)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to open download folder")
+		return nil, err
 	}
-	paths := strings.Split(filepath, "/")
-	foldername := paths[len(paths)-2]
+	log.Debug().Any("file", res).Msg("Uploaded")
+	return res, nil
+}
 
-	// create folder
-	topicFolderId, err := CreateFolderIfNotExists(foldername, parentFolderId)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed create google drive base folder")
-		return err
-	}
-	var parentFolders []string
-	parentFolders = append(parentFolders, topicFolderId)
-	defer file.Close()
-	f := &drive.File{Name: filename, Parents: parentFolders}
-	res, err := srv.Files.
-		Create(f).
-		Media(file).
-		ProgressUpdater(func(now, size int64) { fmt.Printf("%d, %d\r", now, size) }).
-		Do()
+// UploadReader uploads the content of r as filename into the folderId folder,
+// or as a new revision of fileId when set. The reader does not need to be
+// seekable, the media is sent in buffered chunks.
+func UploadReader(srv *drive.Service, record Record, folderId, fileId, filename string, r io.Reader) (*drive.File, error) {
+	f := &drive.File{Name: filename, AppProperties: recordAppProperties(record)}
+	var (
+		res *drive.File
+		err error
+	)
+	if fileId != "" {
+		res, err = srv.Files.
+			Update(fileId, f).
+			SupportsAllDrives(true).
+			Media(r).
+			Fields(uploadedFileFields).
+			ProgressUpdater(uploadProgress(record)).
+			Do()
+	} else {
+		f.Parents = []string{folderId}
+		res, err = srv.Files.
+			Create(f).
+			SupportsAllDrives(true).
+			Media(r).
+			Fields(uploadedFileFields).
+			ProgressUpdater(uploadProgress(record)).
+			Do()
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 	log.Debug().Any("file", res).Msg("Uploaded")
-	return nil
+	return res, nil
+}
+
+// uploadProgress logs the bytes sent of a streamed upload at debug level
+func uploadProgress(record Record) googleapi.ProgressUpdater {
+	return func(now, size int64) {
+		log.Debug().Str("record_id", record.Id).Int64("sent", now).Int64("size", size).Msg("Upload progress")
+	}
+}
+
+// resolveConflict looks up the file of the record in the folder and applies
+// the policy. It returns the existing file when the upload is to be skipped,
+// or the id of the file to upload a new revision of.
+func resolveConflict(driveId, folderId string, record Record, policy ConflictPolicy) (*drive.File, string, error) {
+	existing, err := FindUploadedFile(driveId, folderId, record.Id)
+	if err != nil || existing == nil {
+		return nil, "", err
+	}
+
+	logger := log.With().Str("record_id", record.Id).Str("file_id", existing.Id).Str("policy", string(policy)).Logger()
+	switch policy {
+	case ConflictReplace:
+		logger.Info().Msg("Record already in google drive, replacing it")
+		err := DeleteFile(existing.Id)
+		return nil, "", err
+	case ConflictRevision:
+		logger.Info().Msg("Record already in google drive, uploading a new revision")
+		return nil, existing.Id, nil
+	default:
+		logger.Info().Msg("Record already in google drive, skipping upload")
+		return existing, "", nil
+	}
+}
+
+// FindUploadedFile returns the file tagged with the zoom record id in the
+// folder, nil when there is none
+func FindUploadedFile(driveId, folderId, recordId string) (*drive.File, error) {
+	query := fmt.Sprintf("appProperties has { key='%s' and value='%s' } and '%s' in parents and trashed = false", appPropertyRecordId, escapeQueryValue(recordId), folderId)
+
+	log.Debug().Any("search query", query).Msg("Search uploaded record")
+
+	resp, err := listFiles(driveId, query).Fields(googleapi.Field("files(" + uploadedFileFields + ")")).Do()
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Files) == 0 {
+		return nil, nil
+	}
+	return resp.Files[0], nil
 }
 
-func getFolderID(foldername string, parentFolderId string) (string, error) {
-	query := fmt.Sprintf("mimeType='application/vnd.google-apps.folder' and name='%s'", foldername)
-	if parentFolderId != "" {
-		query = fmt.Sprintf("%s and '%s' in parents", query, parentFolderId)
+// listFiles lists the files matching the query in the driveId shared drive,
+// in my drive of the user when driveId is empty
+func listFiles(driveId, query string) *drive.FilesListCall {
+	call := driveService.Files.List().Q(query).SupportsAllDrives(true)
+	if driveId != "" {
+		call = call.IncludeItemsFromAllDrives(true).Corpora("drive").DriveId(driveId)
 	}
+	return call
+}
+
+// DeleteFile permanently deletes a file from drive
+func DeleteFile(fileId string) error {
+	return driveService.Files.Delete(fileId).SupportsAllDrives(true).Do()
+}
+
+// ShareFile grants the permission on the file, notify sends the drive
+// notification email to users and groups
+func ShareFile(fileId string, perm *drive.Permission, notify bool) (*drive.Permission, error) {
+	call := driveService.Permissions.Create(fileId, perm).SupportsAllDrives(true).Fields("id, type, role, emailAddress, domain")
+	if perm.Type == "user" || perm.Type == "group" {
+		call = call.SendNotificationEmail(notify)
+	}
+	return call.Do()
+}
+
+// RevokeFilePermission removes a permission granted by ShareFile
+func RevokeFilePermission(fileId, permissionId string) error {
+	return driveService.Permissions.Delete(fileId, permissionId).SupportsAllDrives(true).Do()
+}
+
+// escapeQueryValue escapes a value for a single quoted drive query string
+func escapeQueryValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v)
+}
+
+func getFolderID(driveId, foldername string, parentFolderId string) (string, error) {
+	// "root" is the alias of the my drive root folder
+	if parentFolderId == "" {
+		parentFolderId = "root"
+	}
+	query := fmt.Sprintf("mimeType='application/vnd.google-apps.folder' and name='%s' and '%s' in parents", escapeQueryValue(foldername), parentFolderId)
 
 	log.Debug().Any("search query", query).Msg("Search folder name")
 
-	resp, err := driveService.Files.List().Q(query).Do()
+	resp, err := listFiles(driveId, query).Do()
 	if err != nil {
 		return "", err
 	}
@@ -171,8 +322,23 @@ func getFolderID(foldername string, parentFolderId string) (string, error) {
 	return "", nil
 }
 
-func CreateFolderIfNotExists(foldername, parentFolderId string) (string, error) {
-	folderId, err := getFolderID(foldername, parentFolderId)
+// folderMx serializes folder lookups and creation, concurrent uploads of the
+// same meeting would otherwise create the folder twice
+var folderMx sync.Mutex
+
+// CreateFolderIfNotExists returns the id of the foldername folder under
+// parentFolderId in the driveId shared drive, creating it when missing. An
+// empty parentFolderId is the root of the drive.
+func CreateFolderIfNotExists(driveId, foldername, parentFolderId string) (string, error) {
+	folderMx.Lock()
+	defer folderMx.Unlock()
+
+	// the root of a shared drive is the folder with the shared drive id
+	if parentFolderId == "" {
+		parentFolderId = driveId
+	}
+
+	folderId, err := getFolderID(driveId, foldername, parentFolderId)
 	if err != nil {
 		return "", err
 	}
@@ -182,7 +348,7 @@ func CreateFolderIfNotExists(foldername, parentFolderId string) (string, error)
 			parentFolders = append(parentFolders, parentFolderId)
 		}
 		// Create the folder if it doesn't exist
-		folder, err := driveService.Files.Create(&drive.File{Name: foldername, MimeType: "application/vnd.google-apps.folder", Parents: parentFolders}).Do()
+		folder, err := driveService.Files.Create(&drive.File{Name: foldername, MimeType: "application/vnd.google-apps.folder", Parents: parentFolders}).SupportsAllDrives(true).Do()
 		if err != nil {
 			return "", err
 		}
@@ -193,3 +359,18 @@ func CreateFolderIfNotExists(foldername, parentFolderId string) (string, error)
 	}
 	return folderId, nil
 }
+
+// CreateFolderPathIfNotExists creates the nested folders under parentFolderId
+// and returns the id of the innermost one
+func CreateFolderPathIfNotExists(driveId string, folders []string, parentFolderId string) (string, error) {
+	folderId := parentFolderId
+	for _, foldername := range folders {
+		var err error
+		folderId, err = CreateFolderIfNotExists(driveId, foldername, folderId)
+		if err != nil {
+			log.Error().Err(err).Str("folder", foldername).Msg("Failed create google drive folder")
+			return "", err
+		}
+	}
+	return folderId, nil
+}
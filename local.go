@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+)
+
+// LocalDestination stores records in a local or mounted network directory,
+// the ids of folders and files are their absolute paths
+type LocalDestination struct {
+	root   string
+	policy ConflictPolicy
+}
+
+// NewLocalDestination stores below folderName in the path directory
+func NewLocalDestination(path, folderName string, policy ConflictPolicy) *LocalDestination {
+	root, err := filepath.Abs(filepath.Join(path, filepath.FromSlash(folderName)))
+	if err != nil {
+		root = filepath.Join(path, filepath.FromSlash(folderName))
+	}
+	return &LocalDestination{root: root, policy: policy}
+}
+
+func (l *LocalDestination) Name() string {
+	return DestinationLocal
+}
+
+func (l *LocalDestination) EnsureFolder(folders []string) (string, error) {
+	dir := l.root
+	for _, folder := range folders {
+		// rendered names must not leave the destination root
+		if folder == "" || folder == "." || folder == ".." || filepath.Base(folder) != folder {
+			return "", fmt.Errorf("invalid folder name %q", folder)
+		}
+		dir = filepath.Join(dir, folder)
+	}
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// Upload writes r to a temporary file renamed over filename once complete, so
+// an interrupted upload never leaves a truncated record behind
+func (l *LocalDestination) Upload(record Record, folderId, filename string, r io.Reader) (*RemoteFile, error) {
+	if filename == "" || filename == "." || filename == ".." || filepath.Base(filename) != filename {
+		return nil, fmt.Errorf("invalid file name %q", filename)
+	}
+	target := filepath.Join(folderId, filename)
+
+	exists, owner, err := localFileOwner(target)
+	if err != nil {
+		return nil, err
+	}
+	if exists && owner != record.Id {
+		// the file of another record, or one not stored by z2gd, is never overwritten
+		log.Warn().Str("record_id", record.Id).Str("path", target).Str("owner", owner).Msg("File name taken in local destination, adding the record id")
+		filename = recordFileName(filename, record)
+		target = filepath.Join(folderId, filename)
+		exists, owner, err = localFileOwner(target)
+		if err != nil {
+			return nil, err
+		}
+		if exists && owner != record.Id {
+			return nil, fmt.Errorf("local file %s belongs to record %q", target, owner)
+		}
+	}
+
+	logger := log.With().Str("record_id", record.Id).Str("path", target).Str("policy", string(l.policy)).Logger()
+	if exists {
+		if l.policy == ConflictSkip {
+			logger.Info().Msg("Record already in local destination, skipping upload")
+			file, err := l.Stat(target)
+			if err != nil {
+				return nil, err
+			}
+			file.Existed = true
+			return file, nil
+		}
+		logger.Info().Msg("Record already in local destination, replacing it")
+	}
+
+	tmp, err := os.CreateTemp(folderId, "."+filename+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := md5.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return nil, err
+	}
+	// tagged first, a file is never left behind without its record
+	err = writeLocalTag(target, record)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(tmp.Name(), target)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RemoteFile{
+		Id:       target,
+		FolderId: folderId,
+		Name:     filename,
+		Size:     n,
+		Md5:      hex.EncodeToString(hash.Sum(nil)),
+		Link:     localLink(target),
+	}, nil
+}
+
+func (l *LocalDestination) Stat(id string) (*RemoteFile, error) {
+	info, err := os.Stat(id)
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := md5File(id, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteFile{
+		Id:       id,
+		FolderId: filepath.Dir(id),
+		Name:     info.Name(),
+		Size:     info.Size(),
+		Md5:      checksum,
+		Link:     localLink(id),
+	}, nil
+}
+
+func (l *LocalDestination) Delete(id string) error {
+	err := os.Remove(id)
+	if err != nil {
+		return err
+	}
+	os.Remove(localTagPath(id))
+	return nil
+}
+
+// localTagPath returns the hidden file tagging the file at target with its
+// zoom origin, the app properties of drive files
+func localTagPath(target string) string {
+	return filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".zoom.json")
+}
+
+func writeLocalTag(target string, record Record) error {
+	b, err := json.Marshal(recordAppProperties(record))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(localTagPath(target), b, 0o644)
+}
+
+// localFileOwner reports whether the file at target exists and the zoom
+// record id it is tagged with, empty for an untagged file
+func localFileOwner(target string) (bool, string, error) {
+	_, err := os.Stat(target)
+	if os.IsNotExist(err) {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	b, err := os.ReadFile(localTagPath(target))
+	if os.IsNotExist(err) {
+		return true, "", nil
+	}
+	if err != nil {
+		return true, "", err
+	}
+	props := map[string]string{}
+	err = json.Unmarshal(b, &props)
+	if err != nil {
+		return true, "", fmt.Errorf("invalid tag of local file %s: %w", target, err)
+	}
+	return true, props[appPropertyRecordId], nil
+}
+
+func localLink(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalDestinationUploadOwner(t *testing.T) {
+	first := Record{Id: "rec-1", MeetingId: "m"}
+	second := Record{Id: "rec-2", MeetingId: "m"}
+
+	tests := []struct {
+		name        string
+		policy      ConflictPolicy
+		stored      string // owner of the stored video.mp4, "untagged" or empty for none
+		record      Record
+		wantName    string
+		wantExisted bool
+		wantContent string
+	}{
+		{"new file", ConflictSkip, "", first, "video.mp4", false, "new"},
+		{"same record skipped", ConflictSkip, first.Id, first, "video.mp4", true, "old"},
+		{"same record replaced", ConflictReplace, first.Id, first, "video.mp4", false, "new"},
+		{"other record kept", ConflictSkip, first.Id, second, "video-rec-2.mp4", false, "new"},
+		{"other record not replaced", ConflictReplace, first.Id, second, "video-rec-2.mp4", false, "new"},
+		{"untagged file kept", ConflictReplace, "untagged", second, "video-rec-2.mp4", false, "new"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLocalDestination(t.TempDir(), "z2gd", tt.policy)
+			folder, err := l.EnsureFolder([]string{"meeting"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			target := filepath.Join(folder, "video.mp4")
+			if tt.stored != "" {
+				err = os.WriteFile(target, []byte("old"), 0o644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.stored != "" && tt.stored != "untagged" {
+				err = writeLocalTag(target, Record{Id: tt.stored})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			file, err := l.Upload(tt.record, folder, "video.mp4", strings.NewReader("new"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if file.Name != tt.wantName || file.Id != filepath.Join(folder, tt.wantName) {
+				t.Errorf("file = %s %s, want %s", file.Name, file.Id, tt.wantName)
+			}
+			if file.Existed != tt.wantExisted {
+				t.Errorf("Existed = %t, want %t", file.Existed, tt.wantExisted)
+			}
+			b, err := os.ReadFile(file.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.wantContent {
+				t.Errorf("content = %q, want %q", b, tt.wantContent)
+			}
+			_, owner, err := localFileOwner(file.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.wantExisted && owner != tt.record.Id {
+				t.Errorf("owner = %q, want %q", owner, tt.record.Id)
+			}
+			// the file of another record is left untouched
+			if file.Id != target {
+				if b, _ := os.ReadFile(target); string(b) != "old" {
+					t.Errorf("existing file content = %q, want %q", b, "old")
+				}
+			}
+		})
+	}
+}
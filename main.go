@@ -2,13 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
-	"strings"
+	"syscall"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/rs/zerolog"
@@ -28,17 +31,45 @@ func main() {
 		debug          bool
 		err            error
 	)
-	flag.StringVar(&configFileName, "c", "config.yml", "Config file name")
-	flag.BoolVar(&debug, "d", false, "sets log level to debug")
-
+	globalFlags := func(fs *flag.FlagSet) {
+		fs.StringVar(&configFileName, "c", "config.yml", "Config file name")
+		fs.BoolVar(&debug, "d", false, "sets log level to debug")
+	}
+	globalFlags(flag.CommandLine)
+	flag.Usage = usage
 	flag.Parse()
 
+	name := flag.Arg(0)
+	if name == "" {
+		name = "run"
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		usage()
+		os.Exit(2)
+	}
+	var args []string
+	if flag.NArg() > 0 {
+		args = flag.Args()[1:]
+	}
+
+	// the config file may be given after the command, find it before the
+	// command flags override the loaded config
+	probe := defaultConfig()
+	cmd.flagSet(&probe, globalFlags).Parse(args)
+
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	if debug {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	}
 
 	cfg := loadConfig(configFileName)
+	fs := cmd.flagSet(&cfg, globalFlags)
+	fs.Parse(args)
+	if fs.NArg() != len(cmd.args) {
+		fs.Usage()
+		os.Exit(2)
+	}
 
 	log.Debug().Any("config", cfg).Msg("config loaded")
 
@@ -47,61 +78,235 @@ func main() {
 		log.Fatal().Err(err).Msg("Failed to connect sqlite")
 	}
 
-	driveService, err = NewDriveService(context.Background())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		// a second signal terminates immediately
+		stop()
+	}()
+
+	err = cmd.run(ctx, cfg, fs.Args())
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to connect google drive service")
+		log.Fatal().Err(err).Str("command", cmd.name).Msg("Command failed")
 	}
+}
 
-	if cfg.ClientCfg.FetchAPI {
-		zclient = NewZoomClient(Client{
-			AccountId: cfg.ZoomCfg.AccountID,
-			Id:        cfg.ZoomCfg.ClientID,
-			Secret:    cfg.ZoomCfg.ClientSecret,
-		})
-		err = zclient.Authorize()
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to connect zoom service")
-		}
+// connectDrive connects the google drive service when a route stores to drive
+// or force is set, local and s3 only setups run without google credentials
+func connectDrive(ctx context.Context, cfg config, force bool) error {
+	router, err := NewRouter(cfg)
+	if err != nil {
+		return fmt.Errorf("parse routes: %w", err)
+	}
+	if _, ok := router.Destinations()[DestinationDrive]; !ok && !force {
+		return nil
+	}
+	driveService, err = NewDriveService(ctx, cfg.DriveCfg)
+	if err != nil {
+		return fmt.Errorf("connect google drive service: %w", err)
+	}
+	return nil
+}
 
-		err := zclient.FetchAllMeetingRecordsSince(cfg.ClientCfg.UserIds, int(cfg.ClientCfg.Cutoff))
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to get meeting record data")
-		}
+// connectZoom connects the zoom client when fetching, cleaning up or sharing
+// with participants needs it, or when force is set
+func connectZoom(cfg config, force bool) error {
+	cleanupCfg := Client{
+		DeleteDownloaded: cfg.ZoomCfg.DeleteDownloaded,
+		TrashDownloaded:  cfg.ZoomCfg.TrashDownloaded,
+		DeleteSkipped:    cfg.ZoomCfg.DeleteSkipped,
 	}
+	if !force && !cfg.ClientCfg.FetchAPI && cleanupCfg.CleanupAction() == "" && cleanupCfg.SkippedCleanupAction() == "" && !cfg.DriveCfg.Sharing.Participants {
+		return nil
+	}
+
+	zclient = NewZoomClient(Client{
+		AccountId:        cfg.ZoomCfg.AccountID,
+		Id:               cfg.ZoomCfg.ClientID,
+		Secret:           cfg.ZoomCfg.ClientSecret,
+		DeleteDownloaded: cfg.ZoomCfg.DeleteDownloaded,
+		TrashDownloaded:  cfg.ZoomCfg.TrashDownloaded,
+		DeleteSkipped:    cfg.ZoomCfg.DeleteSkipped,
+		MaxRetries:       cfg.ZoomCfg.MaxRetries,
+		MaxRetryWait:     cfg.ZoomCfg.MaxRetryWait,
+		LightRate:        cfg.ZoomCfg.LightRate,
+		MediumRate:       cfg.ZoomCfg.MediumRate,
+		HeavyRate:        cfg.ZoomCfg.HeavyRate,
+	})
+	err := zclient.Authorize()
+	if err != nil {
+		return fmt.Errorf("connect zoom service: %w", err)
+	}
+	return nil
+}
 
+// syncRecords syncs the unsynced records in the database to their destinations
+// and cleans up the zoom recordings afterwards
+func syncRecords(ctx context.Context, cfg config) error {
 	previouslyUnsuccessfulCount, err := sqliteDatabase.CountUnsuccessSyncRecords(cfg.ClientCfg.FileType, cfg.ClientCfg.RecordType, unixToDateTimeString(int64(cfg.ClientCfg.Cutoff)))
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to get count failed records")
+		return fmt.Errorf("count failed records: %w", err)
 	}
 
 	log.Info().Msg(fmt.Sprintf("Total previously unsuccess sync %d", previouslyUnsuccessfulCount))
 
 	err = sqliteDatabase.ResetFailedRecords()
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to reset records")
+		return fmt.Errorf("reset records: %w", err)
 	}
 
+	skippedCount, err := sqliteDatabase.SkipRecordsBelowLimits(cfg.ClientCfg.FileType, cfg.ClientCfg.RecordType, cfg.ClientCfg.MinDuration, cfg.ClientCfg.MinFileSize)
+	if err != nil {
+		return fmt.Errorf("skip records below limits: %w", err)
+	}
+	log.Info().Msg(fmt.Sprintf("Total skipped below min duration or file size %d", skippedCount))
+
 	meetings, err := sqliteDatabase.GetUniqueMeetingByFileExtensionAndRecordType(cfg.ClientCfg.FileType, cfg.ClientCfg.RecordType, unixToDateTimeString(int64(cfg.ClientCfg.Cutoff)))
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to get meeting record data from db")
+		return fmt.Errorf("get meeting record data from db: %w", err)
 	}
 	log.Info().Msg(fmt.Sprintf("Total unsynced meet count = %d", len(meetings)))
 
 	if len(meetings) > 0 && !cfg.ClientCfg.DryRun {
-		parentFolderId, err := CreateFolderIfNotExists(cfg.DriveCfg.FolderName, "")
+		syncMeetings(ctx, cfg, meetings)
+	}
+
+	cleanupCfg := Client{
+		DeleteDownloaded: cfg.ZoomCfg.DeleteDownloaded,
+		TrashDownloaded:  cfg.ZoomCfg.TrashDownloaded,
+		DeleteSkipped:    cfg.ZoomCfg.DeleteSkipped,
+	}
+
+	if action := cleanupCfg.CleanupAction(); action != "" {
+		err = cleanupZoomRecordings(cfg, action)
 		if err != nil {
-			log.Fatal().Err(err).Msg("Failed create google drive base folder")
+			return fmt.Errorf("clean up zoom recordings: %w", err)
 		}
-		for _, fm := range meetings {
-			err = syncMeetRecordToDrive(cfg, fm, cfg.ClientCfg.DownloadLocation, parentFolderId)
+	}
+
+	if action := cleanupCfg.SkippedCleanupAction(); action != "" {
+		err = cleanupSkippedZoomRecordings(cfg, action)
+		if err != nil {
+			return fmt.Errorf("clean up skipped zoom recordings: %w", err)
+		}
+	}
+	return nil
+}
+
+// cleanupZoomRecordings deletes the recordings of fully synced meetings from
+// the zoom cloud, in dry run mode it only logs what would be deleted
+func cleanupZoomRecordings(cfg config, action string) error {
+	dryRun := cfg.ClientCfg.DryRun || cfg.ZoomCfg.CleanupDryRun
+
+	meetings, err := sqliteDatabase.GetMeetingsPendingZoomDeletion(cfg.ClientCfg.FileType, cfg.ClientCfg.RecordType, unixToDateTimeString(int64(cfg.ClientCfg.Cutoff)))
+	if err != nil {
+		return err
+	}
+	log.Info().Int("meetings", len(meetings)).Str("action", action).Bool("dry_run", dryRun).Msg("Synced meetings pending zoom cleanup")
+
+	for _, m := range meetings {
+		for _, r := range m.Records {
+			logger := log.With().Str("topic", m.Topic).Str("meeting_uuid", m.UUID).Str("record_id", r.Id).Str("type", string(r.Type)).Str("action", action).Logger()
+			if dryRun {
+				logger.Info().Msg("Dry run, zoom recording would be deleted")
+				continue
+			}
+			err := zclient.DeleteRecording(m.UUID, r.Id, action)
+			if err != nil {
+				logger.Error().Err(err).Msg("Failed to delete zoom recording")
+				continue
+			}
+			err = sqliteDatabase.SaveZoomDeletion(r.Id, m.UUID, action)
+			if err != nil {
+				return err
+			}
+			logger.Info().Msg("Zoom recording deleted")
+		}
+	}
+	return nil
+}
+
+// fetchMeetings saves the zoom recordings since cutoff to the database, either
+// for the configured user ids, for the discovered users or for the whole account
+func fetchMeetings(ctx context.Context, cfg config) error {
+	usersCfg := cfg.ZoomCfg.Users
+	cutoff := int(cfg.ClientCfg.Cutoff)
+
+	if usersCfg.AccountRecordings {
+		var hosts map[string]struct{}
+		if !usersCfg.filter().IsEmpty() {
+			users, err := zclient.ListUsers(usersCfg.statuses(), usersCfg.filter())
 			if err != nil {
-				log.Error().Err(err).Msg(fmt.Sprintf("Failed to process record with meet id = %d, topic = %s", fm.Id, fm.Topic))
+				return err
 			}
+			hosts = make(map[string]struct{}, len(users))
+			for _, u := range users {
+				hosts[u.Id] = struct{}{}
+			}
+		}
+		return zclient.FetchAccountMeetingRecordsSince(ctx, hosts, cutoff)
+	}
+
+	userIds := cfg.ClientCfg.UserIds
+	if usersCfg.Discover {
+		users, err := zclient.ListUsers(usersCfg.statuses(), usersCfg.filter())
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			userIds = append(userIds, u.Id)
+		}
+	}
+	if len(userIds) == 0 {
+		log.Warn().Msg("No zoom user ids configured, enable zoom.users.discover to list them from zoom")
+	}
+
+	return zclient.FetchAllMeetingRecordsSince(ctx, userIds, cutoff)
+}
+
+// cleanupSkippedZoomRecordings deletes the recordings below the minimum duration
+// or file size from the zoom cloud, in dry run mode it only logs what would be
+// deleted
+func cleanupSkippedZoomRecordings(cfg config, action string) error {
+	dryRun := cfg.ClientCfg.DryRun || cfg.ZoomCfg.CleanupDryRun
+
+	records, err := sqliteDatabase.GetSkippedRecordsPendingZoomDeletion()
+	if err != nil {
+		return err
+	}
+	log.Info().Int("records", len(records)).Str("action", action).Bool("dry_run", dryRun).Msg("Skipped records pending zoom cleanup")
+
+	for _, r := range records {
+		logger := log.With().Str("meeting_uuid", r.MeetingId).Str("record_id", r.Id).Str("type", string(r.Type)).Str("size", r.FileSize.String()).Str("action", action).Logger()
+		if dryRun {
+			logger.Info().Msg("Dry run, skipped zoom recording would be deleted")
+			continue
+		}
+		err := zclient.DeleteRecording(r.MeetingId, r.Id, action)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to delete skipped zoom recording")
+			continue
+		}
+		err = sqliteDatabase.SaveZoomDeletion(r.Id, r.MeetingId, action)
+		if err != nil {
+			return err
 		}
+		logger.Info().Msg("Skipped zoom recording deleted")
 	}
+	return nil
 }
 
-func downloadFileInChunks(filepath string, filename string, url string, chunkSize int) error {
+// downloadProgressInterval is how many bytes are written between two download
+// offset checkpoints in the database
+const downloadProgressInterval = 8 << 20
+
+// downloadFileInChunks downloads url into filepath+filename with range requests
+// of chunkSize bytes. The data is written to a ".part" file whose offset is
+// checkpointed on the record, so a later call resumes where a failed one
+// stopped. The part file is renamed once its size matches the expected size.
+// The hex md5 checksum of the downloaded file is returned.
+func downloadFileInChunks(recordId string, filepath string, filename string, url string, expectedSize int64, chunkSize int64) (string, error) {
 	err := os.MkdirAll(filepath, os.ModePerm)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed create download folder")
@@ -111,101 +316,130 @@ func downloadFileInChunks(filepath string, filename string, url string, chunkSiz
 
 	resp, err := http.Head(url)
 	if err != nil {
-		return err
+		return "", err
 	}
+	resp.Body.Close()
 
-	fileSize, _ := strconv.Atoi(resp.Header.Get("Content-Length"))
+	fileSize, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if fileSize <= 0 {
+		fileSize = expectedSize
+	}
+	if expectedSize > 0 && fileSize != expectedSize {
+		return "", fmt.Errorf("zoom reports %d bytes, expected %d", fileSize, expectedSize)
+	}
+
+	// a previous run may have finished the download but not the upload
+	if info, err := os.Stat(filepath + filename); err == nil && info.Size() == fileSize {
+		log.Info().Any("download path", filepath+filename).Msg("Record already downloaded")
+		return md5File(filepath+filename, fileSize)
+	}
 
-	out, err := os.OpenFile(filepath+filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	partPath := filepath + filename + ".part"
+	offset, err := sqliteDatabase.GetRecordDownloadOffset(recordId)
 	if err != nil {
-		return err
+		return "", err
+	}
+	// the checkpoint may be ahead of or behind what reached the disk, trust
+	// the smaller of both and drop anything written after it
+	if info, err := os.Stat(partPath); err != nil {
+		offset = 0
+	} else if info.Size() < offset {
+		offset = info.Size()
+	}
+	if offset > fileSize {
+		offset = 0
+	}
+
+	out, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
 	}
 	defer out.Close()
 
-	for i := 0; i < fileSize; i += chunkSize {
-		end := i + chunkSize - 1
-		if end > fileSize {
-			end = fileSize
-		}
+	err = out.Truncate(offset)
+	if err != nil {
+		return "", err
+	}
+	_, err = out.Seek(offset, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	if offset > 0 {
+		log.Info().Int64("offset", offset).Int64("size", fileSize).Str("path", partPath).Msg("Resuming record download")
+	}
 
-		req, _ := http.NewRequest("GET", url, nil)
-		req.Header.Add("Range", "bytes="+strconv.Itoa(i)+"-"+strconv.Itoa(end))
-		resp, _ := http.DefaultClient.Do(req)
+	// the checksum covers the already downloaded part too
+	hash := md5.New()
+	err = hashFilePrefix(hash, partPath, offset)
+	if err != nil {
+		return "", err
+	}
+	w := io.MultiWriter(out, hash)
 
-		if resp.StatusCode != http.StatusPartialContent {
-			// If the status is not "Partial Content" - something went wrong
-			return fmt.Errorf("expected HTTP status 206, got %s", resp.Status)
+	for offset < fileSize {
+		end := offset + chunkSize - 1
+		if end >= fileSize {
+			end = fileSize - 1
 		}
 
-		_, err = io.Copy(out, resp.Body)
+		req, err := http.NewRequest("GET", url, nil)
 		if err != nil {
-			return err
+			return "", err
+		}
+		req.Header.Add("Range", "bytes="+strconv.FormatInt(offset, 10)+"-"+strconv.FormatInt(end, 10))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
 		}
 
-		resp.Body.Close()
-	}
-
-	log.Info().Any("download path", filepath+filename).Msg("Record downloaded")
-	return nil
-}
+		if resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			// If the status is not "Partial Content" - something went wrong
+			return "", fmt.Errorf("expected HTTP status 206, got %s", resp.Status)
+		}
 
-func syncMeetRecordToDrive(cfg config, meet Meeting, downloadLocation, parentFolderId string) error {
-	var err error
-	for _, fmr := range meet.Records {
-		retryCount := 0
-		for int(cfg.ClientCfg.Retry) >= retryCount {
-			filepath := fmt.Sprintf("%s/%s - %s - %d/", downloadLocation, formatFolderName(meet.Topic), meet.DateTime, meet.Id)
-			filename := fmt.Sprintf("%s.%s", string(fmr.Type), strings.ToLower(fmr.FileExtension))
-			err := syncRecordToDrive(fmr, filepath, filename, parentFolderId)
-			if err != nil {
-				log.Error().Err(err).Msg(fmt.Sprintf("Failed to sync record from meeting = %s, retry count = %d", meet.Topic, retryCount))
-				err = sqliteDatabase.UpdateRecord(fmr.Id, Failed)
-				if err != nil {
-					return err
+		for offset <= end {
+			n, err := io.CopyN(w, resp.Body, min64(downloadProgressInterval, end-offset+1))
+			offset += n
+			if n > 0 {
+				if err := sqliteDatabase.UpdateRecordDownloadOffset(recordId, offset); err != nil {
+					resp.Body.Close()
+					return "", err
 				}
-				retryCount++
-			} else {
-				log.Info().Str("topic", meet.Topic).Str("extension", fmr.FileExtension).Str("type", string(fmr.Type)).Msg("Record synced to google drive")
-				break
+			}
+			if err != nil {
+				resp.Body.Close()
+				return "", err
 			}
 		}
-	}
-	return err
-}
 
-func syncRecordToDrive(record Record, filepath, filename, parentFolderId string) error {
-	err := sqliteDatabase.UpdateRecord(record.Id, Downloading)
-	if err != nil {
-		return err
+		resp.Body.Close()
 	}
-	err = downloadFileInChunks(filepath, filename, record.DownloadURL, 1024000000)
+
+	err = out.Close()
 	if err != nil {
-		removeFolderIfExists(filepath)
-		return err
+		return "", err
 	}
-	defer os.RemoveAll(filepath)
 
-	err = sqliteDatabase.UpdateRecord(record.Id, Downloaded)
+	info, err := os.Stat(partPath)
 	if err != nil {
-		return err
+		return "", err
 	}
-	err = Upload(driveService, parentFolderId, filepath, filename)
+	if info.Size() != fileSize {
+		os.Remove(partPath)
+		sqliteDatabase.UpdateRecordDownloadOffset(recordId, 0)
+		return "", fmt.Errorf("downloaded %d bytes, expected %d", info.Size(), fileSize)
+	}
+
+	err = os.Rename(partPath, filepath+filename)
 	if err != nil {
-		return err
+		return "", err
 	}
-	err = sqliteDatabase.UpdateRecord(record.Id, Synced)
+	err = sqliteDatabase.UpdateRecordDownloadOffset(recordId, 0)
 	if err != nil {
-		return err
+		return "", err
 	}
-	return nil
-}
 
-func removeFolderIfExists(path string) error {
-	if _, err := os.Stat(path); !os.IsNotExist(err) {
-		err := os.RemoveAll(path)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	log.Info().Any("download path", filepath+filename).Msg("Record downloaded")
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
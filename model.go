@@ -12,8 +12,12 @@ const (
 	Queued      RecordStatus = "queued"
 	Downloading RecordStatus = "downloading"
 	Downloaded  RecordStatus = "downloaded"
+	Uploading   RecordStatus = "uploading" // only used per destination
 	Synced      RecordStatus = "synced"
 	Failed      RecordStatus = "failed"
+	Skipped     RecordStatus = "skipped" // below the minimum duration or file size, never downloaded
+	Corrupt     RecordStatus = "corrupt" // destination size or md5 checksum differs from the downloaded file
+	Removed     RecordStatus = "removed" // trashed or deleted in zoom before it was synced
 )
 
 // RecordType describes the cloud recording types
@@ -41,6 +45,65 @@ type Recordings struct {
 	Meetings      []Meeting `json:"meetings"`
 }
 
+// Users - json response from zoom list users api
+type Users struct {
+	PageSize      int    `json:"page_size"`
+	TotalRecords  int    `json:"total_records"`
+	NextPageToken string `json:"next_page_token"`
+	Users         []User `json:"users"`
+}
+
+// User describes a zoom user of the account
+type User struct {
+	Id       string   `json:"id"`
+	Email    string   `json:"email"`
+	RoleId   string   `json:"role_id"`
+	GroupIds []string `json:"group_ids"`
+	Status   string   `json:"status"`
+	Type     int      `json:"type"`
+}
+
+// Participants is a page of the past meeting participants api
+type Participants struct {
+	PageSize      int           `json:"page_size"`
+	TotalRecords  int           `json:"total_records"`
+	NextPageToken string        `json:"next_page_token"`
+	Participants  []Participant `json:"participants"`
+}
+
+// Participant describes an attendee of a past meeting
+type Participant struct {
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	UserEmail string `json:"user_email"`
+}
+
+// RecordDestination is the sync state of a record in one of its destinations
+type RecordDestination struct {
+	RecordId    string       `json:"record_id"`
+	Destination string       `json:"destination"` // drive, local or s3
+	Status      RecordStatus `json:"status"`
+	RemoteId    string       `json:"remote_id"`
+	FolderId    string       `json:"folder_id"`
+	Link        string       `json:"link"`
+	Size        int64        `json:"size"`
+	Attempts    int          `json:"attempts"`
+	LastError   string       `json:"last_error"`
+	UpdatedAt   string       `json:"updated_at"`
+}
+
+// DrivePermission is a drive permission granted on the file of a record
+type DrivePermission struct {
+	Id        string `json:"id"`
+	FileId    string `json:"file_id"`
+	RecordId  string `json:"record_id"`
+	Type      string `json:"type"` // user, group or domain
+	Role      string `json:"role"`
+	Target    string `json:"target"` // email address or domain
+	GrantedAt string `json:"granted_at"`
+	RevokedAt string `json:"revoked_at"`
+}
+
 // Meeting contains the meeting details
 type Meeting struct {
 	UUID      string    `json:"uuid"` // primary key
@@ -51,6 +114,37 @@ type Meeting struct {
 	DateTime  string    `json:"date_time"`
 	Duration  int       `json:"duration"`
 	AccessKey string    `json:"access_key"`
+	HostId    string    `json:"host_id"`
+	HostEmail string    `json:"host_email"`
+}
+
+// MeetingInfo describes the meetings for API response
+type MeetingInfo struct {
+	UUID      string       `json:"uuid"`
+	Id        uint64       `json:"id"`
+	Topic     string       `json:"topic"`
+	DateTime  string       `json:"date_time"`
+	Duration  int          `json:"duration"`
+	HostId    string       `json:"host_id"`
+	HostEmail string       `json:"host_email"`
+	Records   []RecordInfo `json:"records,omitempty"`
+}
+
+// Info returns the meeting and its records as MeetingInfo
+func (m Meeting) Info() MeetingInfo {
+	info := MeetingInfo{
+		UUID:      m.UUID,
+		Id:        m.Id,
+		Topic:     m.Topic,
+		DateTime:  m.DateTime,
+		Duration:  m.Duration,
+		HostId:    m.HostId,
+		HostEmail: m.HostEmail,
+	}
+	for _, r := range m.Records {
+		info.Records = append(info.Records, r.Info())
+	}
+	return info
 }
 
 // Record describes the records in recording_file array field
@@ -65,18 +159,49 @@ type Record struct {
 	DownloadURL   string       `json:"download_url"`
 	PlayURL       string       `json:"play_url"`
 	Status        RecordStatus `json:"-"`
-	FilePath      string       `json:"file_path"` // local file path
+	FilePath      string       `json:"file_path"` // drive file path
+	Md5           string       `json:"-"`
+	DriveFileId   string       `json:"-"`
+	DriveFolderId string       `json:"-"`
+	WebViewLink   string       `json:"-"`
+	UploadedAt    string       `json:"-"`
+	UploadedSize  FileSize     `json:"-"`
 }
 
 // RecordInfo describes the records for API response
 type RecordInfo struct {
-	Id        string       `json:"id"`         // primary key for Record
-	MeetingId string       `json:"meeting_id"` // foreign key to Meeting.UUID
-	Type      RecordType   `json:"recording_type"`
-	DateTime  string       `json:"date_time"`
-	FileSize  FileSize     `json:"file_size"` // bytes
-	Status    RecordStatus `json:"status"`
-	FilePath  string       `json:"file_path"` // local file path
+	Id            string       `json:"id"`         // primary key for Record
+	MeetingId     string       `json:"meeting_id"` // foreign key to Meeting.UUID
+	Type          RecordType   `json:"recording_type"`
+	DateTime      string       `json:"date_time"`
+	FileSize      FileSize     `json:"file_size"` // bytes
+	Status        RecordStatus `json:"status"`
+	FilePath      string       `json:"file_path"` // drive file path
+	Md5           string       `json:"md5,omitempty"`
+	DriveFileId   string       `json:"drive_file_id,omitempty"`
+	DriveFolderId string       `json:"drive_folder_id,omitempty"`
+	WebViewLink   string       `json:"web_view_link,omitempty"`
+	UploadedAt    string       `json:"uploaded_at,omitempty"`
+	UploadedSize  FileSize     `json:"uploaded_size,omitempty"`
+}
+
+// Info returns the record as RecordInfo
+func (r Record) Info() RecordInfo {
+	return RecordInfo{
+		Id:            r.Id,
+		MeetingId:     r.MeetingId,
+		Type:          r.Type,
+		DateTime:      r.DateTime,
+		FileSize:      r.FileSize,
+		Status:        r.Status,
+		FilePath:      r.FilePath,
+		Md5:           r.Md5,
+		DriveFileId:   r.DriveFileId,
+		DriveFolderId: r.DriveFolderId,
+		WebViewLink:   r.WebViewLink,
+		UploadedAt:    r.UploadedAt,
+		UploadedSize:  r.UploadedSize,
+	}
 }
 
 // FileSize describes the file size
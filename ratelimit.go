@@ -0,0 +1,126 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitCategory describes the zoom api rate limit categories
+type RateLimitCategory string
+
+const (
+	Light  RateLimitCategory = "light"
+	Medium RateLimitCategory = "medium"
+	Heavy  RateLimitCategory = "heavy"
+)
+
+// rateLimiter spaces out requests of a single rate limit category and stops
+// them while the budget of the category is exhausted
+type rateLimiter struct {
+	mx        sync.Mutex
+	interval  time.Duration
+	next      time.Time
+	exhausted time.Time // requests fail until the budget resets
+}
+
+// newRateLimiter creates a limiter allowing perSecond requests per second,
+// zero disables the limit
+func newRateLimiter(perSecond uint) *rateLimiter {
+	if perSecond == 0 {
+		return &rateLimiter{}
+	}
+	return &rateLimiter{interval: time.Second / time.Duration(perSecond)}
+}
+
+// Wait blocks until the next request is allowed
+func (r *rateLimiter) Wait() {
+	r.mx.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	wait := r.next.Sub(now)
+	r.next = r.next.Add(r.interval)
+	r.mx.Unlock()
+
+	time.Sleep(wait)
+}
+
+// Pause holds every following request back until t
+func (r *rateLimiter) Pause(t time.Time) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if t.After(r.next) {
+		r.next = t
+	}
+}
+
+// Exhaust fails every following request until t, for budgets resetting later
+// than a request is willing to wait
+func (r *rateLimiter) Exhaust(t time.Time) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if t.After(r.exhausted) {
+		r.exhausted = t
+	}
+}
+
+// ExhaustedUntil returns when the budget resets, zero when it is not exhausted
+func (r *rateLimiter) ExhaustedUntil() time.Time {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if time.Now().Before(r.exhausted) {
+		return r.exhausted
+	}
+	return time.Time{}
+}
+
+// backoff returns the exponential backoff for the given attempt with
+// jitter, capped at max
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	d := base << attempt
+	if d > max || d <= 0 {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryAfter parses the Retry-After header, in seconds or as http date
+func retryAfter(h http.Header) (time.Duration, bool) {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t), true
+	}
+	// zoom sends the reset of the daily limit as a timestamp
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return time.Until(t), true
+	}
+	return 0, false
+}
+
+// rateLimitReset returns how long a category stays out of budget after a
+// response without remaining requests: Retry-After when sent, the next utc
+// midnight for the daily limit and a second for the per second limit
+func rateLimitReset(h http.Header, now time.Time) time.Duration {
+	if wait, ok := retryAfter(h); ok {
+		return wait
+	}
+	if strings.EqualFold(h.Get("X-RateLimit-Type"), "Daily-limit") {
+		y, m, d := now.UTC().Date()
+		return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC).Sub(now)
+	}
+	return time.Second
+}
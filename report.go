@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// ReportRecord is a record of the report with the meeting it belongs to
+type ReportRecord struct {
+	RecordInfo
+	Topic         string `json:"topic"`
+	HostEmail     string `json:"host_email"`
+	FileExtension string `json:"file_extension"`
+	SizeBytes     int64  `json:"size_bytes"`
+}
+
+// ReportMeeting sums up the sync state of the reported records of a meeting
+type ReportMeeting struct {
+	UUID        string       `json:"uuid"`
+	Id          uint64       `json:"id"`
+	Topic       string       `json:"topic"`
+	DateTime    string       `json:"date_time"`
+	Duration    int          `json:"duration"`
+	HostId      string       `json:"host_id"`
+	HostEmail   string       `json:"host_email"`
+	Status      RecordStatus `json:"status"` // failed when a record failed, queued while one is pending, synced otherwise
+	Records     int          `json:"records"`
+	Synced      int          `json:"synced"`
+	Failed      int          `json:"failed"`
+	Pending     int          `json:"pending"`
+	SizeBytes   int64        `json:"size_bytes"`
+	SyncedBytes int64        `json:"synced_bytes"`
+}
+
+// ReportTotal counts the reported records of a status, the status is "all"
+// for the grand total
+type ReportTotal struct {
+	Status    RecordStatus `json:"status"`
+	Count     int          `json:"count"`
+	SizeBytes int64        `json:"size_bytes"`
+}
+
+// Report is the json document of the report command
+type Report struct {
+	Records  []ReportRecord  `json:"records,omitempty"`
+	Meetings []ReportMeeting `json:"meetings,omitempty"`
+	Totals   []ReportTotal   `json:"totals,omitempty"`
+}
+
+var reportOpts struct {
+	filter RecordFilter
+	since  string
+	until  string
+	format string
+	by     string
+	totals bool
+}
+
+func reportFlags(fs *flag.FlagSet, cfg *config) {
+	reportOpts.filter = RecordFilter{}
+	fs.StringVar(&reportOpts.format, "format", "table", "output format, table, json or csv")
+	fs.StringVar(&reportOpts.by, "by", "record", "one row per record or per meeting")
+	fs.StringVar(&reportOpts.since, "since", "", "oldest recording start, YYYY-MM-DD")
+	fs.StringVar(&reportOpts.until, "until", "", "newest recording start, YYYY-MM-DD inclusive")
+	fs.Var(stringList{&reportOpts.filter.Hosts}, "host", "comma separated zoom host ids or emails")
+	fs.Var(stringList{&reportOpts.filter.Statuses}, "status", "comma separated record statuses")
+	fs.Var(stringList{&reportOpts.filter.Types}, "record-type", "comma separated recording types")
+	fs.StringVar(&reportOpts.filter.FileExtension, "file-type", "", "file extension")
+	fs.BoolVar(&reportOpts.totals, "totals", true, "add the counts and bytes per status, csv appends them after an empty line")
+}
+
+func reportCommand(ctx context.Context, cfg config, args []string) error {
+	filter := reportOpts.filter
+	if reportOpts.since != "" {
+		since, err := time.Parse(time.DateOnly, reportOpts.since)
+		if err != nil {
+			return fmt.Errorf("invalid since: %w", err)
+		}
+		filter.Since = since.Format(time.DateOnly)
+	}
+	if reportOpts.until != "" {
+		until, err := time.Parse(time.DateOnly, reportOpts.until)
+		if err != nil {
+			return fmt.Errorf("invalid until: %w", err)
+		}
+		filter.Until = until.AddDate(0, 0, 1).Format(time.DateOnly)
+	}
+	if reportOpts.by != "record" && reportOpts.by != "meeting" {
+		return fmt.Errorf("invalid by %q, want record or meeting", reportOpts.by)
+	}
+
+	records, err := sqliteDatabase.ListRecords(filter)
+	if err != nil {
+		return err
+	}
+	report, err := buildReport(records, reportOpts.by == "meeting")
+	if err != nil {
+		return err
+	}
+	if !reportOpts.totals {
+		report.Totals = nil
+	}
+
+	switch reportOpts.format {
+	case "table":
+		return writeReportTable(os.Stdout, report)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	case "csv":
+		return writeReportCSV(os.Stdout, report)
+	default:
+		return fmt.Errorf("invalid format %q, want table, json or csv", reportOpts.format)
+	}
+}
+
+// buildReport joins the records with their meetings and sums them up per
+// status, the meetings are summed up from the given records only
+func buildReport(records []Record, byMeeting bool) (*Report, error) {
+	report := &Report{}
+	if byMeeting {
+		report.Meetings = []ReportMeeting{}
+	} else {
+		report.Records = []ReportRecord{}
+	}
+	meetings := map[string]*Meeting{}
+	meetingRows := map[string]int{}
+	totals := map[RecordStatus]int{}
+	all := ReportTotal{Status: "all"}
+
+	for _, r := range records {
+		meet, ok := meetings[r.MeetingId]
+		if !ok {
+			var err error
+			meet, err = sqliteDatabase.GetMeeting(r.MeetingId)
+			if err != nil {
+				return nil, err
+			}
+			meetings[r.MeetingId] = meet
+		}
+
+		i, ok := totals[r.Status]
+		if !ok {
+			i = len(report.Totals)
+			totals[r.Status] = i
+			report.Totals = append(report.Totals, ReportTotal{Status: r.Status})
+		}
+		report.Totals[i].Count++
+		report.Totals[i].SizeBytes += int64(r.FileSize)
+		all.Count++
+		all.SizeBytes += int64(r.FileSize)
+
+		if !byMeeting {
+			report.Records = append(report.Records, ReportRecord{
+				RecordInfo:    r.Info(),
+				Topic:         meet.Topic,
+				HostEmail:     meet.HostEmail,
+				FileExtension: r.FileExtension,
+				SizeBytes:     int64(r.FileSize),
+			})
+			continue
+		}
+
+		j, ok := meetingRows[meet.UUID]
+		if !ok {
+			j = len(report.Meetings)
+			meetingRows[meet.UUID] = j
+			report.Meetings = append(report.Meetings, ReportMeeting{
+				UUID:      meet.UUID,
+				Id:        meet.Id,
+				Topic:     meet.Topic,
+				DateTime:  meet.DateTime,
+				Duration:  meet.Duration,
+				HostId:    meet.HostId,
+				HostEmail: meet.HostEmail,
+			})
+		}
+		m := &report.Meetings[j]
+		m.Records++
+		m.SizeBytes += int64(r.FileSize)
+		switch r.Status {
+		case Synced:
+			m.Synced++
+			m.SyncedBytes += int64(r.FileSize)
+		case Failed, Corrupt:
+			m.Failed++
+		case Skipped, Removed:
+		default:
+			m.Pending++
+		}
+	}
+
+	for i := range report.Meetings {
+		m := &report.Meetings[i]
+		switch {
+		case m.Failed > 0:
+			m.Status = Failed
+		case m.Pending > 0:
+			m.Status = Queued
+		default:
+			m.Status = Synced
+		}
+	}
+	report.Totals = append(report.Totals, all)
+	return report, nil
+}
+
+func writeReportTable(w io.Writer, report *Report) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if report.Meetings != nil {
+		fmt.Fprintln(tw, "START\tMEETING UUID\tHOST\tTOPIC\tRECORDS\tSYNCED\tFAILED\tPENDING\tSIZE\tSTATUS")
+		for _, m := range report.Meetings {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%s\t%s\n", m.DateTime, m.UUID, m.HostEmail, m.Topic, m.Records, m.Synced, m.Failed, m.Pending, FileSize(m.SizeBytes), m.Status)
+		}
+	} else {
+		fmt.Fprintln(tw, "START\tRECORD ID\tHOST\tTOPIC\tTYPE\tEXTENSION\tSIZE\tSTATUS\tPATH")
+		for _, r := range report.Records {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.DateTime, r.Id, r.HostEmail, r.Topic, r.Type, r.FileExtension, r.FileSize, r.Status, r.FilePath)
+		}
+	}
+	if report.Totals != nil {
+		fmt.Fprintln(tw, "\nSTATUS\tRECORDS\tSIZE\tBYTES")
+		for _, t := range report.Totals {
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%d\n", t.Status, t.Count, FileSize(t.SizeBytes), t.SizeBytes)
+		}
+	}
+	return tw.Flush()
+}
+
+func writeReportCSV(w io.Writer, report *Report) error {
+	cw := csv.NewWriter(w)
+	if report.Meetings != nil {
+		cw.Write([]string{"uuid", "id", "date_time", "duration", "host_id", "host_email", "topic", "records", "synced", "failed", "pending", "size_bytes", "synced_bytes", "status"})
+		for _, m := range report.Meetings {
+			cw.Write([]string{
+				m.UUID,
+				strconv.FormatUint(m.Id, 10),
+				m.DateTime,
+				strconv.Itoa(m.Duration),
+				m.HostId,
+				m.HostEmail,
+				m.Topic,
+				strconv.Itoa(m.Records),
+				strconv.Itoa(m.Synced),
+				strconv.Itoa(m.Failed),
+				strconv.Itoa(m.Pending),
+				strconv.FormatInt(m.SizeBytes, 10),
+				strconv.FormatInt(m.SyncedBytes, 10),
+				string(m.Status),
+			})
+		}
+	} else {
+		cw.Write([]string{"id", "meeting_id", "date_time", "host_email", "topic", "recording_type", "file_extension", "size_bytes", "status", "file_path", "drive_file_id", "web_view_link", "uploaded_at"})
+		for _, r := range report.Records {
+			cw.Write([]string{
+				r.Id,
+				r.MeetingId,
+				r.DateTime,
+				r.HostEmail,
+				r.Topic,
+				string(r.Type),
+				r.FileExtension,
+				strconv.FormatInt(r.SizeBytes, 10),
+				string(r.Status),
+				r.FilePath,
+				r.DriveFileId,
+				r.WebViewLink,
+				r.UploadedAt,
+			})
+		}
+	}
+	if report.Totals != nil {
+		cw.Write(nil)
+		cw.Write([]string{"status", "count", "size_bytes"})
+		for _, t := range report.Totals {
+			cw.Write([]string{string(t.Status), strconv.Itoa(t.Count), strconv.FormatInt(t.SizeBytes, 10)})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
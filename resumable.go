@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	driveResumableUploadURL = "https://www.googleapis.com/upload/drive/v3/files"
+	driveResumableUpdateURL = "https://www.googleapis.com/upload/drive/v3/files/"
+	resumableChunkSize      = 32 * 256 * 1024    // must be a multiple of 256 KiB
+	resumableSessionTTL     = 7 * 24 * time.Hour // drive expires sessions after a week
+	statusResumeIncomplete  = 308
+	resumableMaxStalls      = 3 // requests in a row drive may commit nothing of
+)
+
+var errUploadSessionExpired = errors.New("upload session expired")
+
+// errUploadSessionFailed reports a session drive will not complete, it is
+// discarded so the next try starts a new one
+var errUploadSessionFailed = errors.New("upload session failed")
+
+// UploadSession is a drive resumable upload session persisted per record
+type UploadSession struct {
+	RecordId  string
+	URI       string
+	Offset    int64 // bytes committed by drive
+	CreatedAt time.Time
+}
+
+// ResumableUpload uploads file with a drive resumable upload session, as a new
+// file or as a new revision of fileId when it is not empty. The
+// session and the committed offset are stored on the record, an upload cut
+// short by an error or a restart continues from the committed offset on the
+// next call. Sessions older than a week are discarded.
+func ResumableUpload(client *http.Client, recordId, fileId string, meta *drive.File, file *os.File) (*drive.File, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+
+	session, err := sqliteDatabase.GetUploadSession(recordId)
+	if err != nil {
+		return nil, err
+	}
+	if session != nil && time.Since(session.CreatedAt) > resumableSessionTTL {
+		log.Info().Str("record_id", recordId).Time("created_at", session.CreatedAt).Msg("Upload session expired, starting over")
+		session = nil
+	}
+
+	if session != nil {
+		offset, res, err := queryUploadSession(client, session.URI, size)
+		switch {
+		case errors.Is(err, errUploadSessionExpired), errors.Is(err, errUploadSessionFailed):
+			log.Info().Err(err).Str("record_id", recordId).Msg("Upload session no longer usable, starting over")
+			session = nil
+		case err != nil:
+			return nil, err
+		case res != nil:
+			return res, sqliteDatabase.DeleteUploadSession(recordId)
+		default:
+			session.Offset = offset
+			log.Info().Str("record_id", recordId).Int64("offset", offset).Int64("size", size).Msg("Resuming google drive upload")
+		}
+	}
+
+	if session == nil {
+		uri, err := startUploadSession(client, fileId, meta, file, size)
+		if err != nil {
+			return nil, err
+		}
+		session = &UploadSession{RecordId: recordId, URI: uri, CreatedAt: time.Now()}
+		err = sqliteDatabase.SaveUploadSession(*session)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := uploadChunks(client, session, file, size)
+	if errors.Is(err, errUploadSessionExpired) || errors.Is(err, errUploadSessionFailed) {
+		sqliteDatabase.DeleteUploadSession(recordId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, sqliteDatabase.DeleteUploadSession(recordId)
+}
+
+// startUploadSession creates a resumable upload session and returns its uri
+func startUploadSession(client *http.Client, fileId string, meta *drive.File, file *os.File, size int64) (string, error) {
+	body, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+
+	method := http.MethodPost
+	uploadURL := driveResumableUploadURL
+	if fileId != "" {
+		method = http.MethodPatch
+		uploadURL = driveResumableUpdateURL + url.PathEscape(fileId)
+	}
+	uploadURL += "?uploadType=resumable&supportsAllDrives=true&fields=" + url.QueryEscape(uploadedFileFields)
+	req, err := http.NewRequest(method, uploadURL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", detectContentType(file, meta.Name))
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(res.Body)
+		return "", fmt.Errorf("unable to start upload session, status %d, message: %s", res.StatusCode, msg)
+	}
+
+	uri := res.Header.Get("Location")
+	if uri == "" {
+		return "", errors.New("upload session response without location")
+	}
+	return uri, nil
+}
+
+// queryUploadSession asks drive how many bytes of the session are committed,
+// the uploaded file is returned instead when the upload already completed
+func queryUploadSession(client *http.Client, uri string, size int64) (int64, *drive.File, error) {
+	req, err := http.NewRequest(http.MethodPut, uri, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+
+	return parseUploadResponse(res)
+}
+
+// uploadChunks sends the file from the committed offset of the session in
+// resumableChunkSize chunks, checkpointing the offset after every chunk. It
+// gives up once drive committed nothing for resumableMaxStalls requests.
+func uploadChunks(client *http.Client, session *UploadSession, file *os.File, size int64) (*drive.File, error) {
+	buf := make([]byte, resumableChunkSize)
+	stalls := 0
+	for {
+		_, err := file.Seek(session.Offset, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		n, err := io.ReadFull(file, buf[:min64(resumableChunkSize, size-session.Offset)])
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequest(http.MethodPut, session.URI, bytes.NewReader(buf[:n]))
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		} else {
+			req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", session.Offset, session.Offset+int64(n)-1, size))
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		offset, done, err := parseUploadResponse(res)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if done != nil {
+			return done, nil
+		}
+		if offset > size {
+			return nil, fmt.Errorf("%w, %d bytes committed of %d", errUploadSessionFailed, offset, size)
+		}
+		if offset > session.Offset {
+			stalls = 0
+		} else if stalls++; stalls >= resumableMaxStalls {
+			return nil, fmt.Errorf("%w, no progress at %d of %d bytes", errUploadSessionFailed, session.Offset, size)
+		}
+
+		session.Offset = offset
+		err = sqliteDatabase.UpdateUploadSessionOffset(session.RecordId, offset)
+		if err != nil {
+			return nil, err
+		}
+		log.Debug().Str("record_id", session.RecordId).Int64("offset", offset).Int64("size", size).Msg("Upload chunk committed")
+	}
+}
+
+// parseUploadResponse returns the committed offset of an incomplete upload or
+// the file of a completed one
+func parseUploadResponse(res *http.Response) (int64, *drive.File, error) {
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		f := &drive.File{}
+		err := json.NewDecoder(res.Body).Decode(f)
+		return 0, f, err
+	case statusResumeIncomplete:
+		// Range: bytes=0-N, missing when nothing was committed yet
+		r := res.Header.Get("Range")
+		if r == "" {
+			return 0, nil, nil
+		}
+		end, err := strconv.ParseInt(r[strings.LastIndex(r, "-")+1:], 10, 64)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid upload range %q", r)
+		}
+		return end + 1, nil, nil
+	case http.StatusNotFound, http.StatusGone:
+		return 0, nil, errUploadSessionExpired
+	}
+	msg, _ := io.ReadAll(res.Body)
+	if !retryableUploadStatus(res.StatusCode) {
+		return 0, nil, fmt.Errorf("%w, status %d, message: %s", errUploadSessionFailed, res.StatusCode, msg)
+	}
+	return 0, nil, fmt.Errorf("upload request failed, status %d, message: %s", res.StatusCode, msg)
+}
+
+// retryableUploadStatus reports whether the session is worth another request
+// after the status, drive answers rate limits with 403 too
+func retryableUploadStatus(status int) bool {
+	switch status {
+	case http.StatusForbidden, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return status >= 500
+}
+
+// detectContentType guesses the mime type from the file name or content
+func detectContentType(file *os.File, name string) string {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	head := make([]byte, 512)
+	n, _ := file.ReadAt(head, 0)
+	return http.DetectContentType(head[:n])
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseUploadResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		rangeValue string
+		body       string
+		wantOffset int64
+		wantFileId string
+		wantErr    error // the session error wrapped when wantFail is set, nil for none
+		wantFail   bool
+	}{
+		{name: "nothing committed", status: statusResumeIncomplete},
+		{name: "first byte committed", status: statusResumeIncomplete, rangeValue: "bytes=0-0", wantOffset: 1},
+		{name: "chunk committed", status: statusResumeIncomplete, rangeValue: "bytes=0-262143", wantOffset: 262144},
+		{name: "large offset", status: statusResumeIncomplete, rangeValue: "bytes=0-5368709119", wantOffset: 5368709120},
+		{name: "open range", status: statusResumeIncomplete, rangeValue: "bytes=0-", wantFail: true},
+		{name: "not a range", status: statusResumeIncomplete, rangeValue: "all", wantFail: true},
+		{name: "created", status: http.StatusCreated, body: `{"id":"f1","md5Checksum":"abc"}`, wantFileId: "f1"},
+		{name: "completed", status: http.StatusOK, body: `{"id":"f2"}`, wantFileId: "f2"},
+		{name: "completed with invalid json", status: http.StatusOK, body: `{`, wantFail: true},
+		{name: "session not found", status: http.StatusNotFound, wantErr: errUploadSessionExpired, wantFail: true},
+		{name: "session gone", status: http.StatusGone, wantErr: errUploadSessionExpired, wantFail: true},
+		{name: "server error", status: http.StatusServiceUnavailable, body: "backend error", wantFail: true},
+		{name: "rate limited", status: http.StatusTooManyRequests, wantFail: true},
+		{name: "user rate limited", status: http.StatusForbidden, body: "userRateLimitExceeded", wantFail: true},
+		{name: "request timeout", status: http.StatusRequestTimeout, wantFail: true},
+		{name: "bad request", status: http.StatusBadRequest, body: "invalid range", wantErr: errUploadSessionFailed, wantFail: true},
+		{name: "unauthorized", status: http.StatusUnauthorized, wantErr: errUploadSessionFailed, wantFail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := &http.Response{
+				StatusCode: tt.status,
+				Header:     http.Header{},
+				Body:       io.NopCloser(strings.NewReader(tt.body)),
+			}
+			if tt.rangeValue != "" {
+				res.Header.Set("Range", tt.rangeValue)
+			}
+
+			offset, file, err := parseUploadResponse(res)
+			if tt.wantFail {
+				if err == nil {
+					t.Fatalf("parseUploadResponse succeeded, want an error")
+				}
+				for _, sessionErr := range []error{errUploadSessionExpired, errUploadSessionFailed} {
+					if errors.Is(err, sessionErr) != (sessionErr == tt.wantErr) {
+						t.Errorf("error = %v, want %v", err, tt.wantErr)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if offset != tt.wantOffset {
+				t.Errorf("offset = %d, want %d", offset, tt.wantOffset)
+			}
+			switch {
+			case tt.wantFileId == "" && file != nil:
+				t.Errorf("file = %+v, want none", file)
+			case tt.wantFileId != "" && (file == nil || file.Id != tt.wantFileId):
+				t.Errorf("file = %+v, want id %s", file, tt.wantFileId)
+			}
+		})
+	}
+}
+
+func TestUploadChunksStalled(t *testing.T) {
+	sqliteDatabase = newTestStorage(t)
+	tests := []struct {
+		name       string
+		rangeValue func(size int64) string
+		wantCalls  int
+	}{
+		// drive keeps answering 308 for the whole file
+		{"all committed", func(size int64) string { return fmt.Sprintf("bytes=0-%d", size-1) }, resumableMaxStalls + 1},
+		{"nothing committed", func(size int64) string { return "" }, resumableMaxStalls},
+		{"beyond the file", func(size int64) string { return fmt.Sprintf("bytes=0-%d", size) }, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := os.CreateTemp(t.TempDir(), "upload")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			size := int64(1000)
+			_, err = file.Write(make([]byte, size))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			calls := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if calls > 10 {
+					t.Error("upload keeps going without progress")
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				if v := tt.rangeValue(size); v != "" {
+					w.Header().Set("Range", v)
+				}
+				w.WriteHeader(statusResumeIncomplete)
+			}))
+			defer srv.Close()
+
+			session := &UploadSession{RecordId: "r1", URI: srv.URL}
+			_, err = uploadChunks(srv.Client(), session, file, size)
+			if !errors.Is(err, errUploadSessionFailed) {
+				t.Errorf("uploadChunks = %v, want %v", err, errUploadSessionFailed)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("requests = %d, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Route sends the records it matches to a drive destination or skips them.
+// Every condition set must match, a route without conditions matches all.
+type Route struct {
+	Name          string
+	topic         *regexp.Regexp
+	hostIds       []string
+	hostEmails    []string
+	meetingIds    map[uint64]struct{}
+	recordTypes   []string
+	minDuration   uint
+	maxDuration   uint
+	Destinations  []string // drive, local or s3, the record is archived to each
+	FolderName    string
+	SharedDriveId string
+	Skip          bool
+}
+
+// NewRoute compiles a route config, unset destinations fall back to the ones
+// of the default route
+func NewRoute(cfg routeConfig, def Route) (Route, error) {
+	r := Route{
+		Name:          cfg.Name,
+		hostIds:       cfg.HostIds,
+		hostEmails:    cfg.HostEmails,
+		recordTypes:   cfg.RecordTypes,
+		minDuration:   cfg.MinDuration,
+		maxDuration:   cfg.MaxDuration,
+		FolderName:    cfg.FolderName,
+		SharedDriveId: cfg.SharedDriveId,
+		Skip:          cfg.Skip,
+	}
+	if cfg.Topic != "" {
+		topic, err := regexp.Compile(cfg.Topic)
+		if err != nil {
+			return Route{}, fmt.Errorf("invalid topic of route %q: %w", cfg.Name, err)
+		}
+		r.topic = topic
+	}
+	if len(cfg.MeetingIds) > 0 {
+		r.meetingIds = make(map[uint64]struct{}, len(cfg.MeetingIds))
+		for _, id := range cfg.MeetingIds {
+			r.meetingIds[id] = struct{}{}
+		}
+	}
+	var err error
+	r.Destinations, err = destinationKinds(cfg.Destination, cfg.Destinations)
+	if err != nil {
+		return Route{}, fmt.Errorf("invalid destinations of route %q: %w", cfg.Name, err)
+	}
+	if len(r.Destinations) == 0 {
+		r.Destinations = def.Destinations
+	}
+	if r.FolderName == "" {
+		r.FolderName = def.FolderName
+	}
+	if r.SharedDriveId == "" {
+		r.SharedDriveId = def.SharedDriveId
+	}
+	return r, nil
+}
+
+// Match reports whether the record of the meeting matches the route
+func (r Route) Match(meet Meeting, record Record) bool {
+	if r.topic != nil && !r.topic.MatchString(meet.Topic) {
+		return false
+	}
+	if len(r.hostIds) > 0 && !containsAnyFold(r.hostIds, []string{meet.HostId}) {
+		return false
+	}
+	if len(r.hostEmails) > 0 && !containsAnyFold(r.hostEmails, []string{meet.HostEmail}) {
+		return false
+	}
+	if r.meetingIds != nil {
+		if _, ok := r.meetingIds[meet.Id]; !ok {
+			return false
+		}
+	}
+	if len(r.recordTypes) > 0 && !containsAnyFold(r.recordTypes, []string{string(record.Type)}) {
+		return false
+	}
+	if r.minDuration > 0 && meet.Duration < int(r.minDuration) {
+		return false
+	}
+	if r.maxDuration > 0 && meet.Duration > int(r.maxDuration) {
+		return false
+	}
+	return true
+}
+
+// Router picks the route of a record, the first matching route wins and
+// records matching none go to client.destinations
+type Router struct {
+	routes []Route
+	def    Route
+}
+
+func NewRouter(cfg config) (*Router, error) {
+	def := Route{
+		Name:          "default",
+		FolderName:    cfg.DriveCfg.FolderName,
+		SharedDriveId: cfg.DriveCfg.SharedDriveId,
+	}
+	var err error
+	def.Destinations, err = destinationKinds(cfg.ClientCfg.Destination, cfg.ClientCfg.Destinations)
+	if err != nil {
+		return nil, err
+	}
+	if len(def.Destinations) == 0 {
+		def.Destinations = []string{DestinationDrive}
+	}
+	router := &Router{def: def}
+	for i, rc := range cfg.DriveCfg.Routes {
+		if rc.Name == "" {
+			rc.Name = fmt.Sprintf("route-%d", i+1)
+		}
+		r, err := NewRoute(rc, def)
+		if err != nil {
+			return nil, err
+		}
+		router.routes = append(router.routes, r)
+	}
+	return router, nil
+}
+
+func (r *Router) Route(meet Meeting, record Record) Route {
+	for _, route := range r.routes {
+		if route.Match(meet, record) {
+			return route
+		}
+	}
+	return r.def
+}
+
+// Destinations lists the destination kinds the routes store to
+func (r *Router) Destinations() map[string]struct{} {
+	kinds := map[string]struct{}{}
+	for _, route := range append([]Route{r.def}, r.routes...) {
+		if route.Skip {
+			continue
+		}
+		for _, kind := range route.Destinations {
+			kinds[kind] = struct{}{}
+		}
+	}
+	return kinds
+}
+
+// destinationKinds merges the single destination with the list of them, the
+// first one is the primary destination whose file is stored on the record
+func destinationKinds(destination string, destinations []string) ([]string, error) {
+	var kinds []string
+	seen := map[string]struct{}{}
+	for _, kind := range append([]string{destination}, destinations...) {
+		if kind == "" {
+			continue
+		}
+		if !validDestination(kind) {
+			return nil, fmt.Errorf("unknown destination %q", kind)
+		}
+		if _, ok := seen[kind]; ok {
+			continue
+		}
+		seen[kind] = struct{}{}
+		kinds = append(kinds, kind)
+	}
+	return kinds, nil
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// object metadata tagging uploaded objects with their zoom origin
+const (
+	s3MetaRecordId    = "x-amz-meta-zoom-record-id"
+	s3MetaMeetingUUID = "x-amz-meta-zoom-meeting-uuid"
+	s3MetaMd5         = "x-amz-meta-md5"
+)
+
+const (
+	s3MinPartSize = 5 << 20
+	s3MaxParts    = 10000
+	s3PartRetries = 3
+	s3MaxCopySize = 5 << 30 // largest object a single copy request accepts
+)
+
+// S3Client is a minimal client of the S3 api signing requests with aws
+// signature version 4, it works with aws s3 and the s3 compatible storages
+type S3Client struct {
+	cfg      s3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func NewS3Client(cfg s3Config) (*S3Client, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3.bucket is required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+	return &S3Client{cfg: cfg, endpoint: endpoint, client: &http.Client{Timeout: 30 * time.Minute}}, nil
+}
+
+// objectURL returns the url of the object key, the bucket goes into the host
+// unless path style addressing is configured
+func (c *S3Client) objectURL(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	if c.cfg.PathStyle {
+		u.Path = "/" + c.cfg.Bucket + "/" + key
+	} else {
+		u.Host = c.cfg.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u
+}
+
+// do sends a signed request, body is sent with its sha256 and optionally md5
+// checksum so the storage rejects corrupted payloads
+func (c *S3Client) do(method, key string, query url.Values, header http.Header, body []byte, contentMd5 bool) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if contentMd5 {
+		sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	req.ContentLength = int64(len(body))
+	c.sign(req, body, time.Now().UTC())
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		msg, _ := io.ReadAll(res.Body)
+		return nil, &s3Error{method: method, key: key, status: res.StatusCode, body: string(msg)}
+	}
+	return res, nil
+}
+
+type s3Error struct {
+	method string
+	key    string
+	status int
+	body   string
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3 %s %s failed, status %d, message: %s", e.method, e.key, e.status, e.body)
+}
+
+// sign adds the aws signature version 4 authorization of the request
+func (c *S3Client) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.cfg.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "content-md5" || lk == "content-type" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.cfg.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+c.cfg.SecretAccessKey), date)
+	key = hmacSHA256(key, c.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.cfg.AccessKeyId, scope, signedHeaders, signature))
+}
+
+// uploadHeader returns the headers of a new object
+func (c *S3Client) uploadHeader(record Record, key, checksum string) http.Header {
+	h := http.Header{}
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h.Set("Content-Type", contentType)
+	h.Set(s3MetaRecordId, record.Id)
+	h.Set(s3MetaMeetingUUID, record.MeetingId)
+	if checksum != "" {
+		h.Set(s3MetaMd5, checksum)
+	}
+	if c.cfg.StorageClass != "" {
+		h.Set("X-Amz-Storage-Class", c.cfg.StorageClass)
+	}
+	if c.cfg.SSE != "" {
+		h.Set("X-Amz-Server-Side-Encryption", c.cfg.SSE)
+		if c.cfg.SSEKmsKeyId != "" {
+			h.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", c.cfg.SSEKmsKeyId)
+		}
+	}
+	return h
+}
+
+// PutObject uploads an object in a single request
+func (c *S3Client) PutObject(record Record, key string, body []byte) error {
+	sum := md5.Sum(body)
+	res, err := c.do(http.MethodPut, key, nil, c.uploadHeader(record, key, hex.EncodeToString(sum[:])), body, true)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// UploadObject uploads r as the object key, a body larger than a part is sent
+// as a multipart upload which is aborted on failure. The md5 metadata is the
+// record checksum, or the checksum of the streamed bytes when it is not known
+// yet.
+func (c *S3Client) UploadObject(record Record, key string, r io.Reader) error {
+	partSize := int64(c.cfg.PartSize) << 20
+	if partSize < s3MinPartSize {
+		partSize = s3MinPartSize
+	}
+
+	buf := make([]byte, partSize)
+	n, err := io.ReadFull(r, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return c.PutObject(record, key, buf[:n])
+	}
+	if err != nil {
+		return err
+	}
+
+	// the etag of a multipart object is not an md5, the metadata carries it
+	uploadId, err := c.createMultipartUpload(record, key)
+	if err != nil {
+		return err
+	}
+	logger := log.With().Str("record_id", record.Id).Str("key", key).Str("upload_id", uploadId).Logger()
+
+	hash := md5.New()
+	var total int64
+	var parts []s3CompletedPart
+	for partNumber := 1; n > 0; partNumber++ {
+		if partNumber > s3MaxParts {
+			err = fmt.Errorf("object exceeds %d parts of %d bytes", s3MaxParts, partSize)
+			break
+		}
+		hash.Write(buf[:n])
+		total += int64(n)
+		var etag string
+		etag, err = c.uploadPart(key, uploadId, partNumber, buf[:n])
+		if err != nil {
+			break
+		}
+		parts = append(parts, s3CompletedPart{PartNumber: partNumber, ETag: etag})
+		logger.Debug().Int("part", partNumber).Int("size", n).Msg("S3 part uploaded")
+
+		n, err = io.ReadFull(r, buf)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = nil
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = c.completeMultipartUpload(key, uploadId, parts)
+	}
+	if err != nil {
+		if abortErr := c.abortMultipartUpload(key, uploadId); abortErr != nil {
+			logger.Error().Err(abortErr).Msg("Failed to abort s3 multipart upload")
+		}
+		return err
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if record.Md5 != "" {
+		if !strings.EqualFold(record.Md5, checksum) {
+			if err := c.DeleteObject(key); err != nil {
+				logger.Error().Err(err).Msg("Failed to delete corrupt s3 object")
+			}
+			return fmt.Errorf("%w: uploaded md5 %q, expected %q", errCorrupt, checksum, record.Md5)
+		}
+		return nil
+	}
+	// a streamed record has no checksum before the last part
+	return c.replaceMetadata(record, key, checksum, total)
+}
+
+// replaceMetadata copies the object onto itself with the md5 metadata, objects
+// above the copy limit are left without it
+func (c *S3Client) replaceMetadata(record Record, key, checksum string, size int64) error {
+	if size > s3MaxCopySize {
+		log.Warn().Str("record_id", record.Id).Str("key", key).Msg("S3 object too large to add its md5 metadata")
+		return nil
+	}
+	h := c.uploadHeader(record, key, checksum)
+	h.Set("X-Amz-Copy-Source", s3EscapePath("/"+c.cfg.Bucket+"/"+key))
+	h.Set("X-Amz-Metadata-Directive", "REPLACE")
+	res, err := c.do(http.MethodPut, key, nil, h, nil, false)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// a failed copy may still answer 200 with an error document
+	msg, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(msg, []byte("<Error>")) {
+		return &s3Error{method: http.MethodPut, key: key, status: res.StatusCode, body: string(msg)}
+	}
+	return nil
+}
+
+// createMultipartUpload starts a multipart upload, the md5 metadata is set
+// when the record checksum is known
+func (c *S3Client) createMultipartUpload(record Record, key string) (string, error) {
+	res, err := c.do(http.MethodPost, key, url.Values{"uploads": {""}}, c.uploadHeader(record, key, record.Md5), nil, false)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var result struct {
+		UploadId string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(res.Body).Decode(&result)
+	if err != nil {
+		return "", err
+	}
+	return result.UploadId, nil
+}
+
+// uploadPart uploads a part, the part is buffered so it is retried in place
+func (c *S3Client) uploadPart(key, uploadId string, partNumber int, body []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadId}}
+	var err error
+	for attempt := 0; attempt < s3PartRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff(attempt, time.Second, 30*time.Second))
+		}
+		var res *http.Response
+		res, err = c.do(http.MethodPut, key, query, nil, body, true)
+		if err != nil {
+			continue
+		}
+		res.Body.Close()
+		return res.Header.Get("ETag"), nil
+	}
+	return "", err
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (c *S3Client) completeMultipartUpload(key, uploadId string, parts []s3CompletedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	res, err := c.do(http.MethodPost, key, url.Values{"uploadId": {uploadId}}, http.Header{"Content-Type": {"application/xml"}}, body, false)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// a failed completion may still answer 200 with an error document
+	msg, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(msg, []byte("<Error>")) {
+		return &s3Error{method: http.MethodPost, key: key, status: res.StatusCode, body: string(msg)}
+	}
+	return nil
+}
+
+func (c *S3Client) abortMultipartUpload(key, uploadId string) error {
+	res, err := c.do(http.MethodDelete, key, url.Values{"uploadId": {uploadId}}, nil, nil, false)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// HeadObject returns the size and metadata of the object, nil when missing
+func (c *S3Client) HeadObject(key string) (http.Header, int64, error) {
+	res, err := c.do(http.MethodHead, key, nil, nil, nil, false)
+	var s3Err *s3Error
+	if errors.As(err, &s3Err) && s3Err.status == http.StatusNotFound {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	res.Body.Close()
+	return res.Header, res.ContentLength, nil
+}
+
+func (c *S3Client) DeleteObject(key string) error {
+	res, err := c.do(http.MethodDelete, key, nil, nil, nil, false)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// S3Destination stores records as objects below prefix/folder_name of a bucket,
+// the ids of folders and files are their keys
+type S3Destination struct {
+	client *S3Client
+	root   string
+	policy ConflictPolicy
+}
+
+func NewS3Destination(client *S3Client, folderName string, policy ConflictPolicy) *S3Destination {
+	root := strings.Trim(path.Join(client.cfg.Prefix, folderName), "/")
+	return &S3Destination{client: client, root: root, policy: policy}
+}
+
+func (s *S3Destination) Name() string {
+	return DestinationS3
+}
+
+// EnsureFolder returns the key prefix of the folders, object storages have no
+// folders to create
+func (s *S3Destination) EnsureFolder(folders []string) (string, error) {
+	prefix := s.root
+	for _, folder := range folders {
+		if folder == "" || folder == "." || folder == ".." || strings.Contains(folder, "/") {
+			return "", fmt.Errorf("invalid folder name %q", folder)
+		}
+		prefix = path.Join(prefix, folder)
+	}
+	return prefix, nil
+}
+
+func (s *S3Destination) Upload(record Record, folderId, filename string, r io.Reader) (*RemoteFile, error) {
+	key := strings.TrimPrefix(path.Join(folderId, filename), "/")
+
+	header, _, err := s.client.HeadObject(key)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil && header.Get(s3MetaRecordId) != record.Id {
+		// the object of another record, or one not stored by z2gd, is never overwritten
+		owner := header.Get(s3MetaRecordId)
+		log.Warn().Str("record_id", record.Id).Str("key", key).Str("owner", owner).Msg("Key taken in s3, adding the record id")
+		key = strings.TrimPrefix(path.Join(folderId, recordFileName(filename, record)), "/")
+		header, _, err = s.client.HeadObject(key)
+		if err != nil {
+			return nil, err
+		}
+		if header != nil && header.Get(s3MetaRecordId) != record.Id {
+			return nil, fmt.Errorf("s3 object %s belongs to record %q", key, header.Get(s3MetaRecordId))
+		}
+	}
+
+	logger := log.With().Str("record_id", record.Id).Str("key", key).Str("policy", string(s.policy)).Logger()
+	if header != nil {
+		// with versioning enabled on the bucket an overwrite keeps the old one
+		if s.policy == ConflictSkip {
+			logger.Info().Msg("Record already in s3, skipping upload")
+			file, err := s.Stat(key)
+			if err != nil {
+				return nil, err
+			}
+			file.Existed = true
+			return file, nil
+		}
+		logger.Info().Msg("Record already in s3, replacing it")
+	}
+
+	err = s.client.UploadObject(record, key, r)
+	if err != nil {
+		return nil, err
+	}
+	return s.Stat(key)
+}
+
+func (s *S3Destination) Stat(id string) (*RemoteFile, error) {
+	header, size, err := s.client.HeadObject(id)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return nil, fmt.Errorf("s3 object %s not found", id)
+	}
+	return &RemoteFile{
+		Id:       id,
+		FolderId: path.Dir(id),
+		Name:     path.Base(id),
+		Size:     size,
+		Md5:      header.Get(s3MetaMd5),
+		Link:     "s3://" + s.client.cfg.Bucket + "/" + id,
+	}, nil
+}
+
+func (s *S3Destination) Delete(id string) error {
+	return s.client.DeleteObject(id)
+}
+
+// s3EscapePath escapes every path segment per the signature version 4 rules
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = s3Escape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3CanonicalQuery encodes the query sorted by key as signature version 4
+// expects it
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent encodes everything but the unreserved characters
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"1,,2 * * * *",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	tests := []struct {
+		name string
+		expr string
+		from string
+		want string // empty when nothing matches
+	}{
+		{"every minute", "* * * * *", "2024-01-01 10:07", "2024-01-01 10:08"},
+		{"strictly after", "0 10 * * *", "2024-01-01 10:00", "2024-01-02 10:00"},
+		{"step", "*/15 * * * *", "2024-01-01 10:07", "2024-01-01 10:15"},
+		{"step from value", "5/20 * * * *", "2024-01-01 10:06", "2024-01-01 10:25"},
+		{"range step", "10-40/10 * * * *", "2024-01-01 10:41", "2024-01-01 11:10"},
+		{"list", "0 6,18 * * *", "2024-01-01 07:00", "2024-01-01 18:00"},
+		{"hour rolls over the day", "30 2 * * *", "2024-01-31 03:00", "2024-02-01 02:30"},
+		{"month list", "0 12 * 1,7 *", "2024-02-01 00:00", "2024-07-01 12:00"},
+		{"year rolls over", "0 0 1 1 *", "2024-06-01 00:00", "2025-01-01 00:00"},
+		{"weekdays", "0 9 * * 1-5", "2024-01-05 10:00", "2024-01-08 09:00"},
+		{"sunday as 0", "30 6 * * 0", "2024-01-01 00:00", "2024-01-07 06:30"},
+		{"sunday as 7", "30 6 * * 7", "2024-01-01 00:00", "2024-01-07 06:30"},
+		{"day of month skips short months", "0 0 31 * *", "2024-04-01 00:00", "2024-05-31 00:00"},
+		{"leap day", "0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		{"never", "0 0 30 2 *", "2024-01-01 00:00", ""},
+		// a restricted day of month and day of week match when either does
+		{"day of month or week, month day first", "0 0 13 * 5", "2024-02-10 00:00", "2024-02-13 00:00"},
+		{"day of month or week, week day first", "0 0 13 * 5", "2024-02-14 00:00", "2024-02-16 00:00"},
+		{"day of month with star week", "0 0 13 * *", "2024-02-14 00:00", "2024-03-13 00:00"},
+		{"day of week with star month day", "0 0 * * 5", "2024-02-10 00:00", "2024-02-16 00:00"},
+		{"stepped star week day counts as star", "0 0 13 * */7", "2024-02-10 00:00", "2024-02-13 00:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseCron(%q): %v", tt.expr, err)
+			}
+			got := c.Next(at(tt.from).Add(30 * time.Second))
+			if tt.want == "" {
+				if !got.IsZero() {
+					t.Errorf("Next(%s) = %s, want no run", tt.from, got)
+				}
+				return
+			}
+			if want := at(tt.want); !got.Equal(want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.from, got, want)
+			}
+		})
+	}
+}
+
+func TestNewSchedule(t *testing.T) {
+	tests := []struct {
+		cfg     daemonConfig
+		wantErr bool
+	}{
+		{daemonConfig{Interval: "1h"}, false},
+		{daemonConfig{Interval: "1m"}, false},
+		{daemonConfig{Interval: "30s"}, true},
+		{daemonConfig{Interval: "often"}, true},
+		{daemonConfig{Interval: "often", Schedule: "0 * * * *"}, false},
+		{daemonConfig{Interval: "1h", Schedule: "0 * * *"}, true},
+	}
+	for _, tt := range tests {
+		_, err := NewSchedule(tt.cfg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NewSchedule(%+v) error = %v, want error %t", tt.cfg, err, tt.wantErr)
+		}
+	}
+
+	from := time.Date(2024, 1, 1, 10, 7, 0, 0, time.UTC)
+	if got := IntervalSchedule(time.Hour).Next(from); !got.Equal(from.Add(time.Hour)) {
+		t.Errorf("IntervalSchedule.Next = %s, want %s", got, from.Add(time.Hour))
+	}
+}
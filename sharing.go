@@ -0,0 +1,164 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/api/drive/v3"
+)
+
+// Sharer grants the configured drive permissions on uploaded records
+type Sharer struct {
+	cfg driveSharingConfig
+
+	mx           sync.Mutex
+	participants map[string][]string // participant emails by meeting uuid
+}
+
+// NewSharer returns nil when sharing is disabled, Share is a no-op on nil
+func NewSharer(cfg driveSharingConfig) *Sharer {
+	if !cfg.enabled() {
+		return nil
+	}
+	if cfg.Role == "" {
+		cfg.Role = "reader"
+	}
+	return &Sharer{cfg: cfg, participants: map[string][]string{}}
+}
+
+// grantee is a single permission target
+type grantee struct {
+	kind   string // user, group or domain
+	target string // email address or domain
+}
+
+// Share grants the permissions on the drive file of the record, grants already
+// recorded for the record are not repeated
+func (s *Sharer) Share(meet Meeting, record Record, fileId string) {
+	if s == nil {
+		return
+	}
+	logger := log.With().Str("record_id", record.Id).Str("file_id", fileId).Str("role", s.cfg.Role).Logger()
+
+	granted := map[grantee]struct{}{}
+	perms, err := sqliteDatabase.GetDrivePermissions(record.Id)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to get granted drive permissions")
+		return
+	}
+	for _, p := range perms {
+		if p.FileId == fileId && p.RevokedAt == "" {
+			granted[grantee{p.Type, p.Target}] = struct{}{}
+		}
+	}
+
+	for _, g := range s.grantees(meet) {
+		if _, ok := granted[g]; ok {
+			continue
+		}
+		granted[g] = struct{}{}
+
+		perm := &drive.Permission{Type: g.kind, Role: s.cfg.Role}
+		if g.kind == "domain" {
+			perm.Domain = g.target
+		} else {
+			perm.EmailAddress = g.target
+		}
+		created, err := ShareFile(fileId, perm, s.cfg.Notify)
+		if err != nil {
+			logger.Error().Err(err).Str("type", g.kind).Str("target", g.target).Msg("Failed to share google drive file")
+			continue
+		}
+		err = sqliteDatabase.SaveDrivePermission(DrivePermission{
+			Id:       created.Id,
+			FileId:   fileId,
+			RecordId: record.Id,
+			Type:     g.kind,
+			Role:     s.cfg.Role,
+			Target:   g.target,
+		})
+		if err != nil {
+			logger.Error().Err(err).Str("permission_id", created.Id).Msg("Failed to save drive permission")
+			continue
+		}
+		logger.Info().Str("type", g.kind).Str("target", g.target).Msg("Google drive file shared")
+	}
+}
+
+// grantees lists the distinct permission targets of the meeting
+func (s *Sharer) grantees(meet Meeting) []grantee {
+	var grantees []grantee
+	seen := map[grantee]struct{}{}
+	add := func(kind, target string) {
+		target = strings.ToLower(strings.TrimSpace(target))
+		if target == "" {
+			return
+		}
+		g := grantee{kind, target}
+		if _, ok := seen[g]; ok {
+			return
+		}
+		seen[g] = struct{}{}
+		grantees = append(grantees, g)
+	}
+
+	if s.cfg.Host {
+		if meet.HostEmail == "" {
+			log.Warn().Str("meeting_uuid", meet.UUID).Msg("Meeting host email unknown, not shared with the host")
+		}
+		add("user", meet.HostEmail)
+	}
+	if s.cfg.Participants {
+		for _, email := range s.meetingParticipants(meet.UUID) {
+			add("user", email)
+		}
+	}
+	for _, group := range s.cfg.Groups {
+		add("group", group)
+	}
+	add("domain", s.cfg.Domain)
+	return grantees
+}
+
+// meetingParticipants returns the cached participant emails of the meeting,
+// the records of a meeting are shared with the same participants
+func (s *Sharer) meetingParticipants(uuid string) []string {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if emails, ok := s.participants[uuid]; ok {
+		return emails
+	}
+	emails, err := zclient.ListParticipants(uuid)
+	if err != nil {
+		// not cached, the next record of the meeting tries again
+		log.Error().Err(err).Str("meeting_uuid", uuid).Msg("Failed to list zoom meeting participants")
+		return nil
+	}
+	s.participants[uuid] = emails
+	return emails
+}
+
+// revokeShares removes the recorded drive permissions of a record
+func revokeShares(recordId string) error {
+	perms, err := sqliteDatabase.GetDrivePermissions(recordId)
+	if err != nil {
+		return err
+	}
+	for _, p := range perms {
+		if p.RevokedAt != "" {
+			continue
+		}
+		err := RevokeFilePermission(p.FileId, p.Id)
+		if err != nil {
+			return err
+		}
+		err = sqliteDatabase.RevokeDrivePermission(p.FileId, p.Id)
+		if err != nil {
+			return err
+		}
+		log.Info().Str("record_id", recordId).Str("file_id", p.FileId).Str("type", p.Type).Str("target", p.Target).Msg("Google drive permission revoked")
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultFolderTemplate = "{{.Topic}} - {{.Date}} - {{.MeetingId}}"
+	defaultFileTemplate   = "{{.Type}}-{{.RecordId}}.{{.Ext}}"
+)
+
+// PathData is the data available to the drive folder and file templates
+type PathData struct {
+	Host      string    // host email
+	HostId    string    // host zoom user id
+	Topic     string    // meeting topic without characters invalid in file names
+	MeetingId uint64    // meeting id, shared by all occurrences of a recurring meeting
+	UUID      string    // meeting uuid without "/", unique per occurrence
+	RecordId  string    // zoom recording file id, unique per record
+	Type      string    // recording type, e.g. shared_screen_with_speaker_view
+	Ext       string    // lower case file extension, e.g. mp4
+	Start     time.Time // meeting start time
+	Date      string    // meeting start as "2006-01-02 15-04-05"
+	Year      string
+	Month     string
+	Day       string
+}
+
+func newPathData(meet Meeting, record Record) PathData {
+	start, _ := time.ParseInLocation(time.DateTime, meet.DateTime, time.Local)
+	return PathData{
+		Host:      meet.HostEmail,
+		HostId:    meet.HostId,
+		Topic:     formatFolderName(meet.Topic),
+		MeetingId: meet.Id,
+		UUID:      formatFolderName(meet.UUID),
+		RecordId:  formatFolderName(record.Id),
+		Type:      string(record.Type),
+		Ext:       strings.ToLower(record.FileExtension),
+		Start:     start,
+		Date:      strings.ReplaceAll(meet.DateTime, ":", "-"),
+		Year:      start.Format("2006"),
+		Month:     start.Format("01"),
+		Day:       start.Format("02"),
+	}
+}
+
+var templateFuncs = template.FuncMap{
+	// date formats a time with a go layout, {{.Start | date "15-04"}}
+	"date": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+}
+
+// PathTemplate renders the drive folder path and file name of a record
+type PathTemplate struct {
+	folder *template.Template
+	file   *template.Template
+}
+
+// NewPathTemplate parses the folder and file templates, empty ones fall back
+// to the default layout "<topic> - <date> - <id>/<type>-<record id>.<ext>"
+func NewPathTemplate(folder, file string) (*PathTemplate, error) {
+	if folder == "" {
+		folder = defaultFolderTemplate
+	}
+	if file == "" {
+		file = defaultFileTemplate
+	}
+
+	folderTpl, err := template.New("folder").Funcs(templateFuncs).Option("missingkey=error").Parse(folder)
+	if err != nil {
+		return nil, fmt.Errorf("invalid folder template: %w", err)
+	}
+	fileTpl, err := template.New("file").Funcs(templateFuncs).Option("missingkey=error").Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file template: %w", err)
+	}
+	return &PathTemplate{folder: folderTpl, file: fileTpl}, nil
+}
+
+// Render returns the nested folder names and the file name of the record, a
+// "/" in the folder template separates folders. Characters invalid in file
+// names are removed from every folder and the file name.
+func (p *PathTemplate) Render(meet Meeting, record Record) ([]string, string, error) {
+	data := newPathData(meet, record)
+
+	var folder, file strings.Builder
+	if err := p.folder.Execute(&folder, data); err != nil {
+		return nil, "", err
+	}
+	if err := p.file.Execute(&file, data); err != nil {
+		return nil, "", err
+	}
+
+	var folders []string
+	for _, name := range strings.Split(folder.String(), "/") {
+		name = formatFolderName(name)
+		if name != "" {
+			folders = append(folders, name)
+		}
+	}
+
+	filename := formatFolderName(file.String())
+	if filename == "" {
+		return nil, "", fmt.Errorf("file template rendered an empty name for record %s", record.Id)
+	}
+	return folders, filename, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPathTemplateRender(t *testing.T) {
+	meet := Meeting{
+		UUID:      "ab/cd+ef==",
+		Id:        123,
+		Topic:     "Weekly: sync / planning",
+		DateTime:  "2024-01-02 15:04:05",
+		HostEmail: "host@example.com",
+		HostId:    "h1",
+	}
+	record := Record{Id: "rec-1", Type: "shared_screen", FileExtension: "MP4"}
+
+	tests := []struct {
+		name        string
+		folder      string
+		file        string
+		record      Record
+		wantFolders []string
+		wantFile    string
+		wantErr     bool
+	}{
+		{
+			name:        "default",
+			record:      record,
+			wantFolders: []string{"Weekly sync  planning - 2024-01-02 15-04-05 - 123"},
+			wantFile:    "shared_screen-rec-1.mp4",
+		},
+		{
+			name:        "default is unique per record of a type",
+			record:      Record{Id: "rec-2", Type: "shared_screen", FileExtension: "MP4"},
+			wantFolders: []string{"Weekly sync  planning - 2024-01-02 15-04-05 - 123"},
+			wantFile:    "shared_screen-rec-2.mp4",
+		},
+		{
+			name:        "nested folders",
+			folder:      "{{.Host}}/{{.Year}}/{{.Month}}/{{.Topic}}",
+			file:        `{{.Start | date "15-04"}}_{{.Type}}.{{.Ext}}`,
+			record:      record,
+			wantFolders: []string{"host@example.com", "2024", "01", "Weekly sync  planning"},
+			wantFile:    "15-04_shared_screen.mp4",
+		},
+		{
+			name:        "invalid characters removed from every folder",
+			folder:      `{{.UUID}}/{{.Start | date "15:04"}}/a<b>?`,
+			file:        `{{.RecordId}}:{{.Ext}}`,
+			record:      record,
+			wantFolders: []string{"abcd+ef==", "1504", "ab"},
+			wantFile:    "rec-1mp4",
+		},
+		{
+			name:        "empty folders dropped",
+			folder:      "{{.Year}}// ./{{.Day}}",
+			record:      record,
+			wantFolders: []string{"2024", "02"},
+			wantFile:    "shared_screen-rec-1.mp4",
+		},
+		{
+			name:    "empty file name",
+			file:    "{{if false}}x{{end}}",
+			record:  record,
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			file:    "{{.Nope}}",
+			record:  record,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := NewPathTemplate(tt.folder, tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			folders, file, err := tpl.Render(meet, tt.record)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Render error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(folders, tt.wantFolders) {
+				t.Errorf("folders = %q, want %q", folders, tt.wantFolders)
+			}
+			if file != tt.wantFile {
+				t.Errorf("file = %q, want %q", file, tt.wantFile)
+			}
+		})
+	}
+}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"crypto/md5"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
 	"regexp"
 	"strings"
 	"time"
@@ -33,3 +38,59 @@ func unixToDateTimeString(unixtime int64) string {
 	t := time.Unix(unixtime, 0)
 	return t.Format(time.DateTime)
 }
+
+// containsAnyFold reports whether any of values is in list, ignoring case
+func containsAnyFold(list []string, values []string) bool {
+	for _, l := range list {
+		for _, v := range values {
+			if strings.EqualFold(l, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// hashFilePrefix writes the first n bytes of the file into h
+func hashFilePrefix(h hash.Hash, path string, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.CopyN(h, f, n)
+	return err
+}
+
+// md5File returns the hex md5 checksum of the first n bytes of the file
+func md5File(path string, n int64) (string, error) {
+	h := md5.New()
+	err := hashFilePrefix(h, path, n)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// webhookMaxAge rejects replayed webhooks signed longer ago
+const webhookMaxAge = 5 * time.Minute
+
+// WebhookEvent is a zoom webhook notification
+type WebhookEvent struct {
+	Event         string         `json:"event"`
+	EventTs       int64          `json:"event_ts"`
+	DownloadToken string         `json:"download_token"` // authorizes the recording download urls for 24 hours
+	Payload       WebhookPayload `json:"payload"`
+}
+
+type WebhookPayload struct {
+	AccountId  string  `json:"account_id"`
+	Object     Meeting `json:"object"`
+	PlainToken string  `json:"plainToken"` // endpoint.url_validation only
+}
+
+// WebhookHandler receives the zoom recording webhooks, saves the meetings and
+// triggers a sync
+type WebhookHandler struct {
+	secret []byte
+	sync   func()
+}
+
+func NewWebhookHandler(secret string, sync func()) *WebhookHandler {
+	return &WebhookHandler{secret: []byte(secret), sync: sync}
+}
+
+func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "unable to read body", http.StatusBadRequest)
+		return
+	}
+	err = h.verify(r.Header, body)
+	if err != nil {
+		log.Warn().Err(err).Str("remote", r.RemoteAddr).Msg("Rejected zoom webhook")
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	event := WebhookEvent{}
+	err = json.Unmarshal(body, &event)
+	if err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	meet := event.Payload.Object
+	logger := log.With().Str("event", event.Event).Str("meeting_uuid", meet.UUID).Str("topic", meet.Topic).Logger()
+
+	switch event.Event {
+	case "endpoint.url_validation":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"plainToken":     event.Payload.PlainToken,
+			"encryptedToken": h.sign([]byte(event.Payload.PlainToken)),
+		})
+		logger.Info().Msg("Zoom webhook endpoint validated")
+		return
+	case "recording.completed":
+		err = h.saveMeeting(event)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to save meeting to db")
+			http.Error(w, "unable to save meeting", http.StatusInternalServerError)
+			return
+		}
+		logger.Info().Int("records", len(meet.Records)).Msg("Zoom recording completed, sync queued")
+		h.sync()
+	case "recording.trashed", "recording.deleted":
+		action := "trash"
+		if event.Event == "recording.deleted" {
+			action = "delete"
+		}
+		removed, err := sqliteDatabase.RemoveZoomRecords(meet.UUID, recordIds(meet), action)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to remove records")
+			http.Error(w, "unable to remove records", http.StatusInternalServerError)
+			return
+		}
+		logger.Info().Int64("removed", removed).Msg("Zoom recording removed")
+	case "recording.recovered":
+		recovered, err := sqliteDatabase.RecoverZoomRecords(meet.UUID, recordIds(meet))
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to recover records")
+			http.Error(w, "unable to recover records", http.StatusInternalServerError)
+			return
+		}
+		logger.Info().Int64("recovered", recovered).Msg("Zoom recording recovered, sync queued")
+		h.sync()
+	default:
+		logger.Debug().Msg("Ignored zoom webhook")
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// verify checks the x-zm-signature of the body signed at x-zm-request-timestamp
+func (h *WebhookHandler) verify(header http.Header, body []byte) error {
+	ts := header.Get("x-zm-request-timestamp")
+	signature := header.Get("x-zm-signature")
+	if ts == "" || signature == "" {
+		return errors.New("missing signature headers")
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("invalid request timestamp")
+	}
+	if age := time.Since(time.Unix(sec, 0)); age > webhookMaxAge || age < -webhookMaxAge {
+		return errors.New("request timestamp out of range")
+	}
+
+	expected := "v0=" + h.sign([]byte("v0:"+ts+":"+string(body)))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// sign returns the hex hmac sha256 of the message with the secret token
+func (h *WebhookHandler) sign(message []byte) string {
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write(message)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// saveMeeting saves the meeting of a recording.completed event, the download
+// token is added to the download urls as the records are synced right away
+func (h *WebhookHandler) saveMeeting(event WebhookEvent) error {
+	meet := event.Payload.Object
+	if meet.HostEmail == "" && zclient != nil {
+		meet.HostEmail = zclient.hostEmail(meet.HostId)
+	}
+	if event.DownloadToken != "" {
+		for i, r := range meet.Records {
+			u, err := url.Parse(r.DownloadURL)
+			if err != nil {
+				continue
+			}
+			q := u.Query()
+			q.Set("access_token", event.DownloadToken)
+			u.RawQuery = q.Encode()
+			meet.Records[i].DownloadURL = u.String()
+		}
+	}
+	return sqliteDatabase.SaveMeeting(meet)
+}
+
+// recordIds returns the ids of the recording files of the event, none for
+// events about the whole meeting
+func recordIds(meet Meeting) []string {
+	var ids []string
+	for _, r := range meet.Records {
+		if r.Id != "" {
+			ids = append(ids, r.Id)
+		}
+	}
+	return ids
+}
+
+// serveWebhooks receives the zoom webhooks until ctx is done. Syncs run one at
+// a time, webhooks arriving during a sync are coalesced into the next one.
+func serveWebhooks(ctx context.Context, cfg config) error {
+	if cfg.WebhookCfg.SecretToken == "" {
+		return errors.New("webhook.secret_token is required")
+	}
+
+	trigger, done := startSyncTrigger(ctx, "webhook", func(ctx context.Context) error {
+		return withSyncLease(ctx, cfg, func(ctx context.Context) error {
+			return syncRecords(ctx, cfg)
+		})
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle(cfg.WebhookCfg.Path, NewWebhookHandler(cfg.WebhookCfg.SecretToken, trigger))
+	server := &http.Server{Addr: cfg.WebhookCfg.Listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Info().Str("listen", cfg.WebhookCfg.Listen).Str("path", cfg.WebhookCfg.Path).Msg("Receiving zoom webhooks")
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	// let the running sync finish its in-flight transfers
+	<-done
+	return nil
+}
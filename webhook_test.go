@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookSign(t *testing.T) {
+	h := NewWebhookHandler("key", nil)
+	got := h.sign([]byte("The quick brown fox jumps over the lazy dog"))
+	want := "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"
+	if got != want {
+		t.Errorf("sign = %s, want %s", got, want)
+	}
+}
+
+func TestWebhookVerify(t *testing.T) {
+	h := NewWebhookHandler("secret", nil)
+	body := []byte(`{"event":"recording.completed"}`)
+	at := func(d time.Duration) string {
+		return strconv.FormatInt(time.Now().Add(d).Unix(), 10)
+	}
+	now, past, future, stale, early := at(0), at(-4*time.Minute), at(4*time.Minute), at(-6*time.Minute), at(6*time.Minute)
+	signed := func(ts string, body []byte) string {
+		return "v0=" + h.sign([]byte("v0:"+ts+":"+string(body)))
+	}
+
+	tests := []struct {
+		name      string
+		ts        string
+		signature string
+		wantErr   bool
+	}{
+		{"valid", now, signed(now, body), false},
+		{"within the window", past, signed(past, body), false},
+		{"clock skew within the window", future, signed(future, body), false},
+		{"missing timestamp", "", signed(now, body), true},
+		{"missing signature", now, "", true},
+		{"invalid timestamp", "soon", signed("soon", body), true},
+		{"replayed", stale, signed(stale, body), true},
+		{"from the future", early, signed(early, body), true},
+		{"signed at another time", now, signed(past, body), true},
+		{"other body", now, signed(now, []byte(`{}`)), true},
+		{"without version", now, strings.TrimPrefix(signed(now, body), "v0="), true},
+		{"other secret", now, "v0=" + NewWebhookHandler("other", nil).sign([]byte("v0:"+now+":"+string(body))), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.ts != "" {
+				header.Set("x-zm-request-timestamp", tt.ts)
+			}
+			if tt.signature != "" {
+				header.Set("x-zm-signature", tt.signature)
+			}
+			err := h.verify(header, body)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verify = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWebhookURLValidation(t *testing.T) {
+	h := NewWebhookHandler("secret", func() { t.Error("url validation triggered a sync") })
+	body := `{"event":"endpoint.url_validation","payload":{"plainToken":"qgg8vlvZRS6UYooatFL8Aw"}}`
+
+	tests := []struct {
+		name       string
+		method     string
+		signed     bool
+		wantStatus int
+	}{
+		{"signed", http.MethodPost, true, http.StatusOK},
+		{"unsigned", http.MethodPost, false, http.StatusUnauthorized},
+		{"get", http.MethodGet, true, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/", strings.NewReader(body))
+			if tt.signed {
+				ts := strconv.FormatInt(time.Now().Unix(), 10)
+				r.Header.Set("x-zm-request-timestamp", ts)
+				r.Header.Set("x-zm-signature", "v0="+h.sign([]byte("v0:"+ts+":"+body)))
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var res map[string]string
+			err := json.NewDecoder(w.Body).Decode(&res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res["plainToken"] != "qgg8vlvZRS6UYooatFL8Aw" {
+				t.Errorf("plainToken = %q", res["plainToken"])
+			}
+			if want := h.sign([]byte("qgg8vlvZRS6UYooatFL8Aw")); res["encryptedToken"] != want {
+				t.Errorf("encryptedToken = %q, want %q", res["encryptedToken"], want)
+			}
+		})
+	}
+}
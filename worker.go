@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// syncJob is a single record moving through the download and upload pools
+type syncJob struct {
+	meet      Meeting
+	record    Record
+	filepath  string // local download folder
+	localname string // local file name
+	route     Route
+	dests     []Destination // primary destination first
+	pending   []Destination // destinations the record is not synced to yet
+	folders   []string      // destination folders below the route folder
+	filename  string        // destination file name
+	drivePath string        // route folder/folders/filename
+	md5       string        // hex md5 checksum of the downloaded file
+	sharer    *Sharer
+}
+
+func newSyncJob(cfg config, tpl *PathTemplate, route Route, dests []Destination, meet Meeting, record Record) (syncJob, error) {
+	folders, filename, err := tpl.Render(meet, record)
+	if err != nil {
+		return syncJob{}, err
+	}
+	// the local layout stays fixed so partial downloads are found again, the
+	// record id keeps apart the files of a type, e.g. after a pause
+	foldername := fmt.Sprintf("%s - %s - %d", formatFolderName(meet.Topic), meet.DateTime, meet.Id)
+	localname := fmt.Sprintf("%s-%s.%s", string(record.Type), formatFolderName(record.Id), strings.ToLower(record.FileExtension))
+	return syncJob{
+		meet:      meet,
+		record:    record,
+		filepath:  fmt.Sprintf("%s/%s/", cfg.ClientCfg.DownloadLocation, foldername),
+		localname: localname,
+		route:     route,
+		dests:     dests,
+		folders:   folders,
+		filename:  filename,
+		drivePath: strings.Join(append(append([]string{route.FolderName}, folders...), filename), "/"),
+	}, nil
+}
+
+func (j syncJob) logger(worker string) zerolog.Logger {
+	return log.With().
+		Str("worker", worker).
+		Str("topic", j.meet.Topic).
+		Str("record_id", j.record.Id).
+		Str("extension", j.record.FileExtension).
+		Str("type", string(j.record.Type)).
+		Str("route", j.route.Name).
+		Logger()
+}
+
+// syncMeetings downloads and uploads the unsynced records of the meetings with
+// client.download_workers and client.upload_workers workers. Once ctx is done
+// no new record is started, the in-flight ones are finished before returning.
+func syncMeetings(ctx context.Context, cfg config, meetings []Meeting) {
+	tpl, err := NewPathTemplate(cfg.DriveCfg.FolderTemplate, cfg.DriveCfg.FileTemplate)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to parse drive path templates")
+		return
+	}
+	router, err := NewRouter(cfg)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to parse drive routes")
+		return
+	}
+	dests := newDestinations(cfg)
+	sharer := NewSharer(cfg.DriveCfg.Sharing)
+
+	downloadWorkers := int(cfg.ClientCfg.DownloadWorkers)
+	if downloadWorkers < 1 {
+		downloadWorkers = 1
+	}
+	uploadWorkers := int(cfg.ClientCfg.UploadWorkers)
+	if uploadWorkers < 1 {
+		uploadWorkers = 1
+	}
+	log.Info().Int("download_workers", downloadWorkers).Int("upload_workers", uploadWorkers).Msg("Starting sync workers")
+
+	downloads := make(chan syncJob)
+	uploads := make(chan syncJob, uploadWorkers)
+
+	var downloadWg, uploadWg sync.WaitGroup
+	for i := 1; i <= downloadWorkers; i++ {
+		downloadWg.Add(1)
+		go func(worker string) {
+			defer downloadWg.Done()
+			for job := range downloads {
+				logger := job.logger(worker)
+				pending, err := pendingDestinations(job)
+				if err != nil {
+					logger.Error().Err(err).Msg("Failed to get record destinations")
+					continue
+				}
+				job.pending = pending
+				if len(job.pending) == 0 {
+					// synced everywhere by a run stopped before marking the record
+					err := markSynced(job)
+					if err != nil {
+						logger.Error().Err(err).Msg("Failed to update record status")
+					}
+					continue
+				}
+				// a stream feeds a single upload, several destinations share a local file
+				if cfg.ClientCfg.Stream && len(job.pending) == 1 {
+					err := streamRecord(job, job.pending[0])
+					if err == nil {
+						logger.Info().Msg("Record streamed to destination")
+						continue
+					}
+					// a corrupt destination file stays corrupt after a download too
+					status := Failed
+					if errors.Is(err, errCorrupt) {
+						status = Corrupt
+						logger.Error().Err(err).Msg("Record corrupt after stream")
+					} else {
+						// a failed stream cannot be rewound, retry from a local file
+						logger.Warn().Err(err).Msg("Failed to stream record, falling back to download")
+					}
+					if dbErr := sqliteDatabase.FailRecordDestination(job.record.Id, job.pending[0].Name(), status, err); dbErr != nil {
+						logger.Error().Err(dbErr).Msg("Failed to update record destination status")
+					}
+					err = sqliteDatabase.UpdateRecord(job.record.Id, status)
+					if err != nil {
+						logger.Error().Err(err).Msg("Failed to update record status")
+						continue
+					}
+					if status == Corrupt {
+						continue
+					}
+				}
+				if downloadWithRetry(cfg, worker, &job) {
+					uploads <- job
+				}
+			}
+		}(fmt.Sprintf("download-%d", i))
+	}
+	for i := 1; i <= uploadWorkers; i++ {
+		uploadWg.Add(1)
+		go func(worker string) {
+			defer uploadWg.Done()
+			for job := range uploads {
+				uploadWithRetry(cfg, worker, job)
+			}
+		}(fmt.Sprintf("upload-%d", i))
+	}
+
+dispatch:
+	for _, meet := range meetings {
+		for _, record := range meet.Records {
+			if record.Status == Synced || record.Status == Skipped || record.Status == Removed || record.Status == Corrupt {
+				continue
+			}
+			route := router.Route(meet, record)
+			if route.Skip {
+				log.Info().Str("topic", meet.Topic).Str("record_id", record.Id).Str("route", route.Name).Msg("Record skipped by route")
+				continue
+			}
+			recordDests, err := dests.get(route)
+			if err != nil {
+				log.Error().Err(err).Str("route", route.Name).Strs("destinations", route.Destinations).Msg("Failed to set up destination")
+				continue
+			}
+			job, err := newSyncJob(cfg, tpl, route, recordDests, meet, record)
+			if err != nil {
+				log.Error().Err(err).Str("topic", meet.Topic).Str("record_id", record.Id).Msg("Failed to render drive path")
+				continue
+			}
+			job.sharer = sharer
+			select {
+			case downloads <- job:
+			case <-ctx.Done():
+				log.Warn().Msg("Shutting down, finishing in-flight transfers")
+				break dispatch
+			}
+		}
+	}
+
+	close(downloads)
+	downloadWg.Wait()
+	close(uploads)
+	uploadWg.Wait()
+}
+
+// downloadWithRetry downloads the record, retrying up to client.retry times,
+// and reports whether the file is ready for upload
+func downloadWithRetry(cfg config, worker string, job *syncJob) bool {
+	logger := job.logger(worker)
+	for retryCount := 0; int(cfg.ClientCfg.Retry) >= retryCount; retryCount++ {
+		err := downloadRecord(job)
+		if err == nil {
+			logger.Info().Msg("Record downloaded")
+			return true
+		}
+		logger.Error().Err(err).Int("retry count", retryCount).Msg("Failed to download record")
+		err = sqliteDatabase.UpdateRecord(job.record.Id, Failed)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to update record status")
+			return false
+		}
+	}
+	return false
+}
+
+// uploadWithRetry uploads a downloaded record to its pending destinations,
+// each retried up to client.retry times on its own, and removes the local file
+// once synced everywhere. The file is kept for the next run to resume the
+// destinations that failed.
+func uploadWithRetry(cfg config, worker string, job syncJob) {
+	logger := job.logger(worker)
+
+	var failed, corrupt bool
+	for _, dest := range job.pending {
+		err := uploadDestinationWithRetry(cfg, logger, job, dest)
+		if errors.Is(err, errCorrupt) {
+			corrupt = true
+		} else if err != nil {
+			failed = true
+		}
+	}
+
+	switch {
+	case corrupt:
+		// uploading the same file again does not help, it waits for retry or reset
+		removeDownloadedFile(job)
+		err := sqliteDatabase.UpdateRecord(job.record.Id, Corrupt)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to update record status")
+		}
+	case failed:
+		err := sqliteDatabase.UpdateRecord(job.record.Id, Failed)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to update record status")
+		}
+	default:
+		err := markSynced(job)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to update record status")
+			return
+		}
+		removeDownloadedFile(job)
+	}
+}
+
+// uploadDestinationWithRetry uploads the record to a single destination
+func uploadDestinationWithRetry(cfg config, logger zerolog.Logger, job syncJob, dest Destination) error {
+	logger = logger.With().Str("destination", dest.Name()).Logger()
+
+	var err error
+	for retryCount := 0; int(cfg.ClientCfg.Retry) >= retryCount; retryCount++ {
+		err = sqliteDatabase.StartRecordDestination(job.record.Id, dest.Name())
+		if err != nil {
+			return err
+		}
+		err = uploadRecord(job, dest)
+		if err == nil {
+			logger.Info().Msg("Record synced to destination")
+			return nil
+		}
+
+		status := Failed
+		if errors.Is(err, errCorrupt) {
+			status = Corrupt
+		}
+		if dbErr := sqliteDatabase.FailRecordDestination(job.record.Id, dest.Name(), status, err); dbErr != nil {
+			logger.Error().Err(dbErr).Msg("Failed to update record destination status")
+		}
+		if status == Corrupt {
+			logger.Error().Err(err).Msg("Record corrupt after upload")
+			return err
+		}
+		logger.Error().Err(err).Int("retry count", retryCount).Msg("Failed to upload record")
+	}
+	return err
+}
+
+// pendingDestinations returns the destinations of the job the record is not
+// synced to yet
+func pendingDestinations(job syncJob) ([]Destination, error) {
+	states, err := sqliteDatabase.GetRecordDestinations(job.record.Id)
+	if err != nil {
+		return nil, err
+	}
+	synced := map[string]struct{}{}
+	for _, s := range states {
+		if s.Status == Synced {
+			synced[s.Destination] = struct{}{}
+		}
+	}
+	var pending []Destination
+	for _, dest := range job.dests {
+		if _, ok := synced[dest.Name()]; !ok {
+			pending = append(pending, dest)
+		}
+	}
+	return pending, nil
+}
+
+func downloadRecord(job *syncJob) error {
+	err := sqliteDatabase.UpdateRecord(job.record.Id, Downloading)
+	if err != nil {
+		return err
+	}
+	// a failed download keeps its ".part" file to be resumed by the next try
+	checksum, err := downloadFileInChunks(job.record.Id, job.filepath, job.localname, job.record.DownloadURL, int64(job.record.FileSize), 1024000000)
+	if err != nil {
+		return err
+	}
+	job.md5 = checksum
+	// destinations store the checksum along with the file
+	job.record.Md5 = checksum
+	err = sqliteDatabase.UpdateRecordChecksum(job.record.Id, checksum)
+	if err != nil {
+		return err
+	}
+	return sqliteDatabase.UpdateRecord(job.record.Id, Downloaded)
+}
+
+func uploadRecord(job syncJob, dest Destination) error {
+	f, err := os.Open(job.filepath + job.localname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	folderId, err := dest.EnsureFolder(job.folders)
+	if err != nil {
+		return err
+	}
+	file, err := dest.Upload(job.record, folderId, job.filename, f)
+	if err != nil {
+		return err
+	}
+	err = verifyUpload(dest, file, info.Size(), job.md5)
+	if err != nil {
+		return err
+	}
+	return markDestinationSynced(job, dest, file)
+}
+
+// markDestinationSynced stores the file of the record in the destination, the
+// path of the primary destination and the google drive file are stored on the
+// record too
+func markDestinationSynced(job syncJob, dest Destination, file *RemoteFile) error {
+	err := sqliteDatabase.SyncRecordDestination(job.record.Id, dest.Name(), file)
+	if err != nil {
+		return err
+	}
+	// a destination adds the record id to a file name taken by another record
+	drivePath := job.drivePath
+	if file.Name != "" && file.Name != job.filename {
+		drivePath = strings.TrimSuffix(job.drivePath, job.filename) + file.Name
+	}
+	if dest == job.dests[0] {
+		err = sqliteDatabase.UpdateRecordUpload(job.record.Id, drivePath, file.Size)
+		if err != nil {
+			return err
+		}
+	}
+	_, isDrive := dest.(*DriveDestination)
+	if isDrive {
+		err = sqliteDatabase.UpdateRecordDriveFile(job.record.Id, file)
+		if err != nil {
+			return err
+		}
+	}
+	log.Info().
+		Str("record_id", job.record.Id).
+		Str("destination", dest.Name()).
+		Str("path", drivePath).
+		Str("file_id", file.Id).
+		Str("link", file.Link).
+		Str("size", FileSize(file.Size).String()).
+		Msg("Record stored in destination")
+	// the record is archived even when sharing fails, the error is only logged
+	if isDrive {
+		job.sharer.Share(job.meet, job.record, file.Id)
+	}
+	return nil
+}
+
+// markSynced marks the record synced once it is in every destination
+func markSynced(job syncJob) error {
+	return sqliteDatabase.UpdateRecord(job.record.Id, Synced)
+}
+
+// errCorrupt reports a destination file not matching the downloaded bytes
+var errCorrupt = errors.New("record corrupt")
+
+// verifyUpload compares the size and md5 checksum reported by the destination
+// with the local ones, the checksum only when the destination reports one. A
+// mismatching uploaded file is deleted, a file kept by the skip policy never is.
+func verifyUpload(dest Destination, file *RemoteFile, size int64, checksum string) error {
+	if file.Size == size && (file.Md5 == "" || strings.EqualFold(file.Md5, checksum)) {
+		return nil
+	}
+
+	if !file.Existed {
+		err := dest.Delete(file.Id)
+		if err != nil {
+			log.Error().Err(err).Str("file_id", file.Id).Msg("Failed to delete corrupt destination file")
+		}
+	}
+	return fmt.Errorf("%w: %s has %d bytes with md5 %q, expected %d bytes with md5 %q", errCorrupt, dest.Name(), file.Size, file.Md5, size, checksum)
+}
+
+// streamRecord pipes the zoom download straight into the destination without
+// a local file and checks the streamed byte count against the record size and
+// the destination size and checksum against the streamed bytes
+func streamRecord(job syncJob, dest Destination) error {
+	err := sqliteDatabase.UpdateRecord(job.record.Id, Downloading)
+	if err != nil {
+		return err
+	}
+	err = sqliteDatabase.StartRecordDestination(job.record.Id, dest.Name())
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Get(job.record.DownloadURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("expected HTTP status 200, got %s", resp.Status)
+	}
+
+	folderId, err := dest.EnsureFolder(job.folders)
+	if err != nil {
+		return err
+	}
+
+	hash := md5.New()
+	body := &countingReader{r: io.TeeReader(resp.Body, hash)}
+	file, err := dest.Upload(job.record, folderId, job.filename, body)
+	if err != nil {
+		return err
+	}
+
+	if file.Existed {
+		// nothing was streamed, the kept file is checked against the record
+		if job.record.FileSize > 0 && file.Size != int64(job.record.FileSize) {
+			return fmt.Errorf("%w: %s has %d bytes, expected %d", errCorrupt, dest.Name(), file.Size, job.record.FileSize)
+		}
+		if file.Md5 != "" {
+			err = sqliteDatabase.UpdateRecordChecksum(job.record.Id, file.Md5)
+			if err != nil {
+				return err
+			}
+		}
+		err = markDestinationSynced(job, dest, file)
+		if err != nil {
+			return err
+		}
+		return markSynced(job)
+	}
+
+	if job.record.FileSize > 0 && body.n != int64(job.record.FileSize) {
+		err := dest.Delete(file.Id)
+		if err != nil {
+			log.Error().Err(err).Str("file_id", file.Id).Msg("Failed to delete incomplete destination file")
+		}
+		return fmt.Errorf("streamed %d bytes, expected %d", body.n, job.record.FileSize)
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	err = verifyUpload(dest, file, body.n, checksum)
+	if err != nil {
+		return err
+	}
+	err = sqliteDatabase.UpdateRecordChecksum(job.record.Id, checksum)
+	if err != nil {
+		return err
+	}
+
+	err = markDestinationSynced(job, dest, file)
+	if err != nil {
+		return err
+	}
+	return markSynced(job)
+}
+
+// removeDownloadedFile removes the record file and its meeting folder once
+// no other record of the meeting is left in it
+func removeDownloadedFile(job syncJob) {
+	err := os.Remove(job.filepath + job.localname)
+	if err != nil && !os.IsNotExist(err) {
+		log.Error().Err(err).Str("path", job.filepath+job.localname).Msg("Failed to remove downloaded file")
+	}
+	// fails while other records of the meeting are still in the folder
+	os.Remove(job.filepath)
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	b64 "encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"strings"
@@ -26,6 +28,11 @@ type Client struct {
 	DeleteDownloaded bool   `yaml:"delete_downloaded"` // Delete downloaded files from Zoom cloud
 	TrashDownloaded  bool   `yaml:"trash_downloaded"`  // Move downloaded files to trash
 	DeleteSkipped    bool   `yaml:"delete_skipped"`    // Delete skipped files from Zoom cloud (the ones that are shorter than MinDuration)
+	MaxRetries       uint   `yaml:"max_retries"`       // Retries on rate limit, server errors and network errors
+	MaxRetryWait     uint   `yaml:"max_retry_wait"`    // Longest Retry-After in seconds we are willing to wait for
+	LightRate        uint   `yaml:"light_rate"`        // Requests per second for light apis
+	MediumRate       uint   `yaml:"medium_rate"`       // Requests per second for medium apis
+	HeavyRate        uint   `yaml:"heavy_rate"`        // Requests per second for heavy apis
 }
 
 type AccessToken struct {
@@ -42,6 +49,23 @@ type ZoomClient struct {
 	token    *AccessToken
 	mx       sync.Mutex
 	endpoint string
+	limiters map[RateLimitCategory]*rateLimiter
+
+	hostEmails map[string]string // user id to email of the listed users
+	emailsMx   sync.RWMutex      // guards hostEmails, webhooks read it during a fetch
+}
+
+// hostEmail returns the email of a listed user, empty when not listed
+func (z *ZoomClient) hostEmail(userId string) string {
+	z.emailsMx.RLock()
+	defer z.emailsMx.RUnlock()
+	return z.hostEmails[userId]
+}
+
+func (z *ZoomClient) setHostEmail(userId, email string) {
+	z.emailsMx.Lock()
+	defer z.emailsMx.Unlock()
+	z.hostEmails[userId] = email
 }
 
 func NewZoomClient(cfg Client) *ZoomClient {
@@ -56,6 +80,12 @@ func NewZoomClient(cfg Client) *ZoomClient {
 		cfg:      &cfg,
 		client:   client,
 		endpoint: uri.String(),
+		limiters: map[RateLimitCategory]*rateLimiter{
+			Light:  newRateLimiter(cfg.LightRate),
+			Medium: newRateLimiter(cfg.MediumRate),
+			Heavy:  newRateLimiter(cfg.HeavyRate),
+		},
+		hostEmails: map[string]string{},
 	}
 }
 
@@ -112,76 +142,414 @@ func (z *ZoomClient) GetToken() (*AccessToken, error) {
 	return z.token, nil
 }
 
-func (z *ZoomClient) FetchAllMeetingRecordsSince(userIds []string, cutoff int) error {
+// refreshToken authorizes again regardless of the current token expiry
+func (z *ZoomClient) refreshToken() error {
+	z.mx.Lock()
+	defer z.mx.Unlock()
+
+	return z.Authorize()
+}
+
+// FetchAllMeetingRecordsSince fetches the recordings of the users, it stops
+// between pages once ctx is done
+func (z *ZoomClient) FetchAllMeetingRecordsSince(ctx context.Context, userIds []string, cutoff int) error {
 	_, err := z.GetToken()
 	if err != nil {
 		return errors.Join(fmt.Errorf("unable to get token"), err)
 	}
 
-	// meetings := []Meeting{}
-
 	for _, userId := range userIds {
-		from := time.Now().AddDate(0, 0, -30)
-		to := time.Now()
+		path := fmt.Sprintf("/users/%s/recordings", userId)
+		// user recordings do not carry the host email, zoom accepts it as user id
+		var hostEmail string
+		if strings.Contains(userId, "@") {
+			hostEmail = userId
+		}
+		err := z.fetchRecordingsSince(ctx, path, hostEmail, cutoff, nil)
+		if err != nil {
+			return err
+		}
+	}
 
-		params := url.Values{}
-		params.Add(`page_size`, "300")
-		params.Add(`from`, from.Format("2006-01-02"))
-		params.Add(`to`, to.Format("2006-01-02"))
+	return nil
+}
 
-		path := "/users/%s/recordings"
-		pathWithUserId := fmt.Sprintf(path, userId)
-		endpoint := z.endpoint + pathWithUserId
-		log.Debug().Any("endpoint", endpoint).Msg("Zoom endpoint")
+// FetchAccountMeetingRecordsSince fetches the recordings of every user in the
+// account through the account level recordings endpoint. When hosts is not nil
+// only meetings hosted by one of the given user ids are saved. It stops
+// between pages once ctx is done.
+func (z *ZoomClient) FetchAccountMeetingRecordsSince(ctx context.Context, hosts map[string]struct{}, cutoff int) error {
+	_, err := z.GetToken()
+	if err != nil {
+		return errors.Join(fmt.Errorf("unable to get token"), err)
+	}
 
-		req, err := http.NewRequest(http.MethodGet, endpoint+"?"+params.Encode(), nil)
-		if err != nil {
-			return err
+	var keep func(m Meeting) bool
+	if hosts != nil {
+		keep = func(m Meeting) bool {
+			_, ok := hosts[m.HostId]
+			return ok
 		}
+	}
 
-		req.Header.Add(`Authorization`, fmt.Sprintf("Bearer %s", z.token.AccessToken))
-		req.Header.Add(`Host`, "zoom.us")
-		req.Header.Add(`Content-Type`, "application/json")
+	// "me" resolves to the account the server-to-server app belongs to
+	return z.fetchRecordingsSince(ctx, "/accounts/me/recordings", "", cutoff, keep)
+}
 
-		for int(to.Unix()) >= cutoff {
-			_, err := zclient.GetToken()
-			if err != nil {
-				return err
-			}
-			log.Debug().Any("params", params.Encode()).Msg("Zoom params")
+// fetchRecordingsSince walks a recordings list endpoint backwards in 30 days
+// windows until cutoff, following next_page_token inside every window, and
+// saves the meetings accepted by keep (all of them when keep is nil). Meetings
+// without host email get the one of a listed user or hostEmail.
+func (z *ZoomClient) fetchRecordingsSince(ctx context.Context, path, hostEmail string, cutoff int, keep func(m Meeting) bool) error {
+	from := time.Now().AddDate(0, 0, -30)
+	to := time.Now()
 
-			req.URL.RawQuery = params.Encode()
-			res, err := z.client.Do(req)
-			if err != nil {
+	params := url.Values{}
+	params.Add(`page_size`, "300")
+	params.Add(`from`, from.Format("2006-01-02"))
+	params.Add(`to`, to.Format("2006-01-02"))
+
+	log.Debug().Any("endpoint", z.endpoint+path).Msg("Zoom endpoint")
+
+	windowCount := 0
+	pageCount := 0
+	meetingCount := 0
+	for int(to.Unix()) >= cutoff {
+		windowCount++
+		params.Del(`next_page_token`)
+		for {
+			if err := ctx.Err(); err != nil {
 				return err
 			}
-			defer res.Body.Close()
-
-			if res.StatusCode != http.StatusOK {
-				return fmt.Errorf("unable to authorize with account id: %s and client id: %s, status %d, message: %s", z.cfg.AccountId, z.cfg.Id, res.StatusCode, res.Body)
-			}
+			log.Debug().Any("params", params.Encode()).Msg("Zoom params")
 
 			recordings := &Recordings{}
-
-			if err := json.NewDecoder(res.Body).Decode(recordings); err != nil {
+			err := z.getJSON(path, params, Medium, recordings)
+			if err != nil {
 				return err
 			}
+			pageCount++
 
 			for _, fm := range recordings.Meetings {
+				if keep != nil && !keep(fm) {
+					continue
+				}
+				meetingCount++
+				if fm.HostEmail == "" {
+					fm.HostEmail = z.hostEmail(fm.HostId)
+				}
+				if fm.HostEmail == "" {
+					fm.HostEmail = hostEmail
+				}
 				err = sqliteDatabase.SaveMeeting(fm)
 				if err != nil {
 					log.Error().Err(err).Msg(fmt.Sprintf("Failed to save meeting to db with meet id = %d, topic = %s", fm.Id, fm.Topic))
 				}
 			}
-			// meetings = append(meetings, recordings.Meetings...)
 
-			from = from.AddDate(0, 0, -30)
-			to = to.AddDate(0, 0, -30)
-			params.Set(`from`, from.Format("2006-01-02"))
-			params.Set(`to`, to.Format("2006-01-02"))
-			time.Sleep(500 * time.Millisecond) // avoid rate limit
+			log.Debug().
+				Str("path", path).
+				Str("from", params.Get(`from`)).
+				Str("to", params.Get(`to`)).
+				Int("meetings", len(recordings.Meetings)).
+				Int("total_records", recordings.TotalRecords).
+				Bool("has_next_page", recordings.NextPageToken != "").
+				Msg("Zoom recordings page fetched")
+
+			if recordings.NextPageToken == "" {
+				break
+			}
+			params.Set(`next_page_token`, recordings.NextPageToken)
+		}
+
+		from = from.AddDate(0, 0, -30)
+		to = to.AddDate(0, 0, -30)
+		params.Set(`from`, from.Format("2006-01-02"))
+		params.Set(`to`, to.Format("2006-01-02"))
+	}
+	log.Info().
+		Str("path", path).
+		Int("windows", windowCount).
+		Int("pages", pageCount).
+		Int("meetings", meetingCount).
+		Msg("Zoom recordings fetched")
+
+	return nil
+}
+
+// UserFilter selects zoom users by email, group and role. Empty include lists
+// match everyone, exclude lists always win over include lists.
+type UserFilter struct {
+	IncludeEmails []string
+	ExcludeEmails []string
+	IncludeGroups []string
+	ExcludeGroups []string
+	IncludeRoles  []string
+	ExcludeRoles  []string
+}
+
+// IsEmpty reports whether the filter accepts every user
+func (f UserFilter) IsEmpty() bool {
+	return len(f.IncludeEmails) == 0 && len(f.ExcludeEmails) == 0 &&
+		len(f.IncludeGroups) == 0 && len(f.ExcludeGroups) == 0 &&
+		len(f.IncludeRoles) == 0 && len(f.ExcludeRoles) == 0
+}
+
+// Match reports whether the user passes the filter
+func (f UserFilter) Match(u User) bool {
+	email := []string{u.Email}
+	role := []string{u.RoleId}
+
+	if containsAnyFold(f.ExcludeEmails, email) || containsAnyFold(f.ExcludeGroups, u.GroupIds) || containsAnyFold(f.ExcludeRoles, role) {
+		return false
+	}
+	if len(f.IncludeEmails) > 0 && !containsAnyFold(f.IncludeEmails, email) {
+		return false
+	}
+	if len(f.IncludeGroups) > 0 && !containsAnyFold(f.IncludeGroups, u.GroupIds) {
+		return false
+	}
+	if len(f.IncludeRoles) > 0 && !containsAnyFold(f.IncludeRoles, role) {
+		return false
+	}
+	return true
+}
+
+// ListUsers lists every user of the account with the given statuses
+// (active, inactive, pending) that passes the filter
+func (z *ZoomClient) ListUsers(statuses []string, filter UserFilter) ([]User, error) {
+	var users []User
+	for _, status := range statuses {
+		params := url.Values{}
+		params.Add(`page_size`, "300")
+		params.Add(`status`, status)
+
+		for {
+			page := &Users{}
+			err := z.getJSON("/users", params, Medium, page)
+			if err != nil {
+				return nil, err
+			}
+			for _, u := range page.Users {
+				z.setHostEmail(u.Id, u.Email)
+				if filter.Match(u) {
+					users = append(users, u)
+				}
+			}
+			if page.NextPageToken == "" {
+				break
+			}
+			params.Set(`next_page_token`, page.NextPageToken)
 		}
 	}
 
+	log.Info().Strs("statuses", statuses).Int("users", len(users)).Msg("Zoom users listed")
+	return users, nil
+}
+
+// CleanupAction returns the zoom recording delete action for synced
+// recordings, trash wins over delete, empty when cleanup is disabled
+func (c Client) CleanupAction() string {
+	switch {
+	case c.TrashDownloaded:
+		return "trash"
+	case c.DeleteDownloaded:
+		return "delete"
+	}
+	return ""
+}
+
+// SkippedCleanupAction returns the zoom recording delete action for skipped
+// recordings, they are moved to trash unless delete is configured
+func (c Client) SkippedCleanupAction() string {
+	if !c.DeleteSkipped {
+		return ""
+	}
+	if c.DeleteDownloaded && !c.TrashDownloaded {
+		return "delete"
+	}
+	return "trash"
+}
+
+// DeleteRecording deletes a single recording file of a meeting from the zoom
+// cloud, action is either "trash" or "delete" (permanent)
+func (z *ZoomClient) DeleteRecording(meetingUUID, recordId, action string) error {
+	params := url.Values{}
+	params.Add(`action`, action)
+
+	path := fmt.Sprintf("/meetings/%s/recordings/%s", escapeMeetingUUID(meetingUUID), url.PathEscape(recordId))
+	res, err := z.do(http.MethodDelete, path, params, Light)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("unable to %s recording %s of meeting %s, status %d, message: %s", action, recordId, meetingUUID, res.StatusCode, body)
+	}
 	return nil
 }
+
+// ListParticipants returns the distinct participant emails of a past meeting,
+// participants joining without a signed in zoom account have no email
+func (z *ZoomClient) ListParticipants(meetingUUID string) ([]string, error) {
+	params := url.Values{}
+	params.Add(`page_size`, "300")
+
+	path := fmt.Sprintf("/past_meetings/%s/participants", escapeMeetingUUID(meetingUUID))
+	seen := map[string]struct{}{}
+	var emails []string
+	for {
+		page := &Participants{}
+		err := z.getJSON(path, params, Medium, page)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range page.Participants {
+			email := strings.ToLower(p.UserEmail)
+			if email == "" {
+				continue
+			}
+			if _, ok := seen[email]; ok {
+				continue
+			}
+			seen[email] = struct{}{}
+			emails = append(emails, email)
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		params.Set(`next_page_token`, page.NextPageToken)
+	}
+
+	log.Debug().Str("meeting_uuid", meetingUUID).Int("participants", len(emails)).Msg("Zoom participants listed")
+	return emails, nil
+}
+
+// escapeMeetingUUID escapes a meeting uuid for use in a path, zoom requires
+// uuids starting with "/" or containing "//" to be encoded twice
+func escapeMeetingUUID(uuid string) string {
+	if strings.HasPrefix(uuid, "/") || strings.Contains(uuid, "//") {
+		return url.PathEscape(url.PathEscape(uuid))
+	}
+	return url.PathEscape(uuid)
+}
+
+// getJSON sends an authorized GET request to the zoom api and decodes the
+// json response into v
+func (z *ZoomClient) getJSON(path string, params url.Values, category RateLimitCategory, v any) error {
+	res, err := z.do(http.MethodGet, path, params, category)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("unable to get %s with account id: %s and client id: %s, status %d, message: %s", path, z.cfg.AccountId, z.cfg.Id, res.StatusCode, body)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// do sends an authorized request to the zoom api within the budget of the
+// rate limit category. Rate limited (429) and server error (5xx) responses
+// are retried honoring Retry-After or with exponential backoff, a 401 refreshes
+// the token and is retried once. The last response is returned to the caller
+// when the retries are exhausted.
+func (z *ZoomClient) do(method, path string, params url.Values, category RateLimitCategory) (*http.Response, error) {
+	limiter, ok := z.limiters[category]
+	if !ok {
+		limiter = z.limiters[Medium]
+	}
+	maxRetryWait := time.Duration(z.cfg.MaxRetryWait) * time.Second
+
+	reauthorized := false
+	retries := 0
+	for {
+		if until := limiter.ExhaustedUntil(); !until.IsZero() {
+			return nil, fmt.Errorf("zoom %s rate limit exhausted until %s", category, until.Format(time.RFC3339))
+		}
+		token, err := z.GetToken()
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequest(method, z.endpoint+path+"?"+params.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Add(`Authorization`, fmt.Sprintf("Bearer %s", token.AccessToken))
+		req.Header.Add(`Host`, "zoom.us")
+		req.Header.Add(`Content-Type`, "application/json")
+
+		limiter.Wait()
+		res, err := z.client.Do(req)
+		if err != nil {
+			if retries >= int(z.cfg.MaxRetries) {
+				return nil, err
+			}
+			wait := backoff(retries, time.Second, maxRetryWait)
+			log.Warn().Err(err).Str("path", path).Int("retry", retries+1).Dur("wait", wait).Msg("Zoom request failed, retrying")
+			limiter.Pause(time.Now().Add(wait))
+			retries++
+			continue
+		}
+
+		if res.Header.Get("X-RateLimit-Remaining") == "0" {
+			// the budget of this category is spent, hold it back until the reset
+			wait := rateLimitReset(res.Header, time.Now())
+			if wait > maxRetryWait {
+				limiter.Exhaust(time.Now().Add(wait))
+			} else {
+				limiter.Pause(time.Now().Add(wait))
+			}
+		}
+
+		switch {
+		case res.StatusCode == http.StatusUnauthorized && !reauthorized:
+			res.Body.Close()
+			reauthorized = true
+			log.Warn().Str("path", path).Msg("Zoom token rejected, refreshing token")
+			if err := z.refreshToken(); err != nil {
+				return nil, err
+			}
+			continue
+		case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= http.StatusInternalServerError:
+			if retries >= int(z.cfg.MaxRetries) {
+				return res, nil
+			}
+			wait, ok := retryAfter(res.Header)
+			if !ok && res.StatusCode == http.StatusTooManyRequests && strings.EqualFold(res.Header.Get("X-RateLimit-Type"), "Daily-limit") {
+				wait, ok = rateLimitReset(res.Header, time.Now()), true
+			}
+			if !ok {
+				wait = backoff(retries, time.Second, maxRetryWait)
+			}
+			if wait > maxRetryWait {
+				limiter.Exhaust(time.Now().Add(wait))
+				log.Error().
+					Str("path", path).
+					Str("limit_type", res.Header.Get("X-RateLimit-Type")).
+					Dur("retry_after", wait).
+					Msg("Zoom rate limit wait is longer than max_retry_wait")
+				return res, nil
+			}
+			res.Body.Close()
+			log.Warn().
+				Str("path", path).
+				Int("status", res.StatusCode).
+				Str("category", res.Header.Get("X-RateLimit-Category")).
+				Int("retry", retries+1).
+				Dur("wait", wait).
+				Msg("Zoom request throttled, retrying")
+			limiter.Pause(time.Now().Add(wait))
+			retries++
+			continue
+		}
+
+		return res, nil
+	}
+}